@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// 拒绝查询的方式
+const (
+	aclActionRefuse = "refuse"
+	aclActionDrop   = "drop"
+)
+
+// 被访问控制拒绝的查询在查询日志中的响应码
+const (
+	aclRefusedCode = "ACL_REFUSED"
+	aclDroppedCode = "ACL_DROPPED"
+)
+
+// accessList 客户端访问控制列表。deny 优先于 allow；allow 非空时只允许其中的客户端
+type accessList struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+	// 为 true 时不响应被拒绝的查询，否则返回 REFUSED
+	drop bool
+}
+
+// newAccessList 根据配置创建访问控制列表，未配置 allow 与 deny 时返回 nil（允许所有客户端）
+func newAccessList(cfg AccessControlConfig) (*accessList, error) {
+	a := &accessList{}
+	switch cfg.Action {
+	case "", aclActionRefuse:
+	case aclActionDrop:
+		a.drop = true
+	default:
+		return nil, fmt.Errorf("unknown access control action %q (use refuse or drop)", cfg.Action)
+	}
+
+	var err error
+	if a.allow, err = parsePrefixes(cfg.Allow); err != nil {
+		return nil, err
+	}
+	if a.deny, err = parsePrefixes(cfg.Deny); err != nil {
+		return nil, err
+	}
+	if len(a.allow) == 0 && len(a.deny) == 0 {
+		return nil, nil
+	}
+	return a, nil
+}
+
+// parsePrefixes 解析 CIDR 列表，单个 IP 地址视为 /32 或 /128
+func parsePrefixes(values []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			addr, err := netip.ParseAddr(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid access control entry %q", value)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid access control entry %q", value)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// permits 判断是否允许客户端查询。nil 列表允许所有客户端
+func (a *accessList) permits(addr netip.Addr) bool {
+	if a == nil {
+		return true
+	}
+	for _, prefix := range a.deny {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if len(a.allow) == 0 {
+		return true
+	}
+	for _, prefix := range a.allow {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// String 返回列表的描述，用于日志输出
+func (a *accessList) String() string {
+	action := aclActionRefuse
+	if a.drop {
+		action = aclActionDrop
+	}
+	return fmt.Sprintf("%d allow, %d deny, %s", len(a.allow), len(a.deny), action)
+}
+
+// remoteIP 返回客户端连接的 IP 地址，IPv4 映射的 IPv6 地址转换为 IPv4
+func remoteIP(addr net.Addr) netip.Addr {
+	var ip netip.Addr
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		ip = addr.AddrPort().Addr()
+	case *net.TCPAddr:
+		ip = addr.AddrPort().Addr()
+	}
+	return ip.Unmap()
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultBootstrapTimeout = 5
+	// bootstrapMinTTL 限制引导解析结果的最短缓存时间，避免频繁查询
+	bootstrapMinTTL = 60 * time.Second
+)
+
+// bootstrapEntry 缓存的主机名解析结果
+type bootstrapEntry struct {
+	ips      []net.IP
+	expireAt time.Time
+	// 后台刷新进行中
+	refreshing bool
+}
+
+// bootstrapResolver 解析上游服务器的主机名。本程序作为系统解析器时，
+// 使用系统解析器解析 DoH 主机名会查询自身形成循环，因此优先使用静态映射与配置的明文 DNS 服务器
+type bootstrapResolver struct {
+	config  *Config
+	servers []string
+	timeout time.Duration
+	dialer  *net.Dialer
+
+	mu sync.Mutex
+	// 静态映射（bootstrap.hosts 与服务器的 ips），键为小写主机名
+	static map[string][]net.IP
+	cache  map[string]*bootstrapEntry
+}
+
+// newBootstrapResolver 根据配置创建引导解析器
+func newBootstrapResolver(config *Config) *bootstrapResolver {
+	timeout := config.Bootstrap.Timeout
+	if timeout <= 0 {
+		timeout = defaultBootstrapTimeout
+	}
+
+	r := &bootstrapResolver{
+		config:  config,
+		timeout: time.Duration(timeout) * time.Second,
+		dialer:  &net.Dialer{},
+		static:  make(map[string][]net.IP),
+		cache:   make(map[string]*bootstrapEntry),
+	}
+
+	for _, server := range config.Bootstrap.Servers {
+		addr, err := plainDNSAddr(server)
+		if err != nil {
+			log.Printf("[WARNING] Bootstrap server %s: %v", server, err)
+			continue
+		}
+		r.servers = append(r.servers, addr)
+	}
+	for host, ips := range config.Bootstrap.Hosts {
+		r.addStatic(host, ips)
+	}
+
+	return r
+}
+
+// plainDNSAddr 将 ip、ip:port 或 udp://ip[:port] 形式的 DNS 服务器地址转换为 ip:port
+func plainDNSAddr(server string) (string, error) {
+	server = strings.TrimPrefix(server, schemeUDP)
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		host, port = strings.Trim(server, "[]"), defaultPlainDNSPort
+	}
+	if net.ParseIP(host) == nil {
+		return "", fmt.Errorf("bootstrap DNS servers must be IP addresses")
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// addStatic 添加主机名的静态地址
+func (r *bootstrapResolver) addStatic(host string, ips []string) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			log.Printf("[WARNING] Bootstrap host %s: invalid IP address %q", host, s)
+			continue
+		}
+		r.static[host] = append(r.static[host], ip)
+	}
+}
+
+// addServerIPs 将上游服务器配置的 ips 作为其主机名的静态地址
+func (r *bootstrapResolver) addServerIPs(server *DoHServerConfig) {
+	if len(server.IPs) == 0 {
+		return
+	}
+	u, err := url.Parse(server.URL)
+	if err != nil || u.Hostname() == "" {
+		return
+	}
+	r.addStatic(u.Hostname(), server.IPs)
+}
+
+// lookup 解析主机名：IP 地址直接返回，其次依次使用静态映射、缓存与引导 DNS 服务器。
+// 未配置引导 DNS 服务器时使用系统解析器
+func (r *bootstrapResolver) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	key := strings.ToLower(strings.TrimSuffix(host, "."))
+
+	r.mu.Lock()
+	if ips, ok := r.static[key]; ok {
+		r.mu.Unlock()
+		return ips, nil
+	}
+	if len(r.servers) == 0 {
+		r.mu.Unlock()
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		ips := make([]net.IP, 0, len(addrs))
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+		return ips, nil
+	}
+
+	entry, ok := r.cache[key]
+	if ok && time.Now().Before(entry.expireAt) {
+		r.mu.Unlock()
+		return entry.ips, nil
+	}
+	if ok {
+		// 已过期：继续使用旧地址，同时在后台刷新
+		if !entry.refreshing {
+			entry.refreshing = true
+			go r.refresh(key)
+		}
+		r.mu.Unlock()
+		return entry.ips, nil
+	}
+	r.mu.Unlock()
+
+	ips, ttl, err := r.resolve(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	r.store(key, ips, ttl)
+	return ips, nil
+}
+
+// refresh 在后台重新解析过期的主机名，失败时保留旧地址并稍后重试
+func (r *bootstrapResolver) refresh(host string) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	ips, ttl, err := r.resolve(ctx, host)
+	if err != nil {
+		log.Printf("[WARNING] Bootstrap: failed to refresh %s: %v", host, err)
+		r.mu.Lock()
+		if entry, ok := r.cache[host]; ok {
+			entry.refreshing = false
+			entry.expireAt = time.Now().Add(bootstrapMinTTL)
+		}
+		r.mu.Unlock()
+		return
+	}
+	r.store(host, ips, ttl)
+}
+
+// store 缓存解析结果
+func (r *bootstrapResolver) store(host string, ips []net.IP, ttl time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cache[host] = &bootstrapEntry{
+		ips:      ips,
+		expireAt: time.Now().Add(max(ttl, bootstrapMinTTL)),
+	}
+	if r.config.Logging.Level == "debug" {
+		log.Printf("Bootstrap: %s -> %v (ttl: %s)", host, ips, ttl)
+	}
+}
+
+// resolve 向引导 DNS 服务器查询 A 与 AAAA 记录，返回地址（IPv4 优先）与最小 TTL
+func (r *bootstrapResolver) resolve(ctx context.Context, host string) ([]net.IP, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+
+	type result struct {
+		ips []net.IP
+		ttl uint32
+		err error
+	}
+	qtypes := []uint16{dns.TypeA, dns.TypeAAAA}
+	results := make([]result, len(qtypes))
+
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func(i int, qtype uint16) {
+			defer wg.Done()
+			ips, ttl, err := r.query(ctx, host, qtype)
+			results[i] = result{ips: ips, ttl: ttl, err: err}
+		}(i, qtype)
+	}
+	wg.Wait()
+
+	var ips []net.IP
+	var ttl uint32
+	var lastErr error
+	for _, res := range results {
+		if res.err != nil {
+			lastErr = res.err
+			continue
+		}
+		if len(res.ips) > 0 && (len(ips) == 0 || res.ttl < ttl) {
+			ttl = res.ttl
+		}
+		ips = append(ips, res.ips...)
+	}
+	if len(ips) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no addresses found")
+		}
+		return nil, 0, fmt.Errorf("bootstrap lookup for %s failed: %v", host, lastErr)
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// query 依次向引导 DNS 服务器发送单个类型的查询
+func (r *bootstrapResolver) query(ctx context.Context, host string, qtype uint16) ([]net.IP, uint32, error) {
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(host), qtype)
+	req.RecursionDesired = true
+
+	client := &dns.Client{}
+	var lastErr error
+	for _, server := range r.servers {
+		resp, _, err := client.ExchangeContext(ctx, req, server)
+		if err == nil && resp.Truncated {
+			tcpClient := &dns.Client{Net: "tcp"}
+			resp, _, err = tcpClient.ExchangeContext(ctx, req, server)
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.Rcode != dns.RcodeSuccess {
+			lastErr = fmt.Errorf("%s returned %s", server, dns.RcodeToString[resp.Rcode])
+			continue
+		}
+
+		var ips []net.IP
+		var ttl uint32
+		for _, rr := range resp.Answer {
+			var ip net.IP
+			switch rr := rr.(type) {
+			case *dns.A:
+				ip = rr.A
+			case *dns.AAAA:
+				ip = rr.AAAA
+			default:
+				continue
+			}
+			if len(ips) == 0 || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+			ips = append(ips, ip)
+		}
+		return ips, ttl, nil
+	}
+	return nil, 0, lastErr
+}
+
+// dial 解析目标主机名后依次尝试各个地址建立连接，用于所有基于 TCP 的上游传输
+func (r *bootstrapResolver) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := r.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := r.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no addresses for %s", host)
+	}
+	return nil, lastErr
+}
+
+// resolveAddr 将 host:port 解析为第一个可用的 ip:port，用于 QUIC 等基于 UDP 的传输
+func (r *bootstrapResolver) resolveAddr(ctx context.Context, addr string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", err
+	}
+	ips, err := r.lookup(ctx, host)
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", fmt.Errorf("no addresses for %s", host)
+	}
+	return net.JoinHostPort(ips[0].String(), port), nil
+}
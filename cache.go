@@ -0,0 +1,341 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultCacheSize      = 4096
+	defaultCacheMaxTTL    = 86400
+	defaultCacheMaxNegTTL = 3600
+	defaultStaleTTL       = 30
+	defaultMaxStale       = 86400
+	defaultPrefetchRatio  = 10
+	defaultPrefetchHits   = 2
+)
+
+// DNSCache 基于 LRU 的 DNS 响应缓存，按应答 TTL 过期
+type DNSCache struct {
+	config *Config
+	size   int
+	minTTL uint32
+	maxTTL uint32
+	maxNeg uint32
+	// serve-stale（RFC 8767）
+	staleTTL uint32
+	maxStale time.Duration
+	// 预取：剩余 TTL 低于原 TTL 的 prefetchRatio% 且命中次数不少于 prefetchHits 时触发
+	prefetch      bool
+	prefetchRatio uint32
+	prefetchHits  int
+	mu            sync.Mutex
+	items         map[string]*list.Element
+	lru           *list.List
+}
+
+// cacheEntry 缓存条目
+type cacheEntry struct {
+	key      string
+	msg      *dns.Msg
+	storedAt time.Time
+	expireAt time.Time
+	ttl      uint32
+	hits     int
+	// 是否已有后台预取在进行
+	prefetching bool
+}
+
+// NewDNSCache 创建新的 DNS 缓存
+func NewDNSCache(config *Config) *DNSCache {
+	size := config.Cache.Size
+	if size <= 0 {
+		size = defaultCacheSize
+	}
+	maxTTL := config.Cache.MaxTTL
+	if maxTTL <= 0 {
+		maxTTL = defaultCacheMaxTTL
+	}
+	maxNeg := config.Cache.MaxNegativeTTL
+	if maxNeg <= 0 {
+		maxNeg = defaultCacheMaxNegTTL
+	}
+	minTTL := config.Cache.MinTTL
+	if minTTL < 0 {
+		minTTL = 0
+	}
+
+	c := &DNSCache{
+		config: config,
+		size:   size,
+		minTTL: uint32(minTTL),
+		maxTTL: uint32(maxTTL),
+		maxNeg: uint32(maxNeg),
+		items:  make(map[string]*list.Element),
+		lru:    list.New(),
+	}
+
+	if config.Cache.ServeStale {
+		c.staleTTL = uint32(config.Cache.StaleTTL)
+		if c.staleTTL == 0 {
+			c.staleTTL = defaultStaleTTL
+		}
+		maxStale := config.Cache.MaxStale
+		if maxStale <= 0 {
+			maxStale = defaultMaxStale
+		}
+		c.maxStale = time.Duration(maxStale) * time.Second
+	}
+
+	if config.Cache.Prefetch {
+		c.prefetch = true
+		c.prefetchRatio = uint32(config.Cache.PrefetchThreshold)
+		if c.prefetchRatio == 0 || c.prefetchRatio >= 100 {
+			c.prefetchRatio = defaultPrefetchRatio
+		}
+		c.prefetchHits = config.Cache.PrefetchMinHits
+		if c.prefetchHits <= 0 {
+			c.prefetchHits = defaultPrefetchHits
+		}
+	}
+
+	return c
+}
+
+// cacheKey 根据上游组名称、查询名称、类型、类别、DO 位和 ECS 子网生成缓存键。
+// 不同监听可能把同一查询发送到不同的上游组，其应答分别缓存
+func cacheKey(group string, req *dns.Msg) string {
+	q := req.Question[0]
+	do := false
+	if opt := req.IsEdns0(); opt != nil {
+		do = opt.Do()
+	}
+	return fmt.Sprintf("%s|%s|%d|%d|%t", group, strings.ToLower(q.Name), q.Qtype, q.Qclass, do) + ecsKey(req)
+}
+
+// Get 查询缓存，命中时返回按已过去时间扣减 TTL 后的响应副本。
+// 第二个返回值表示该条目即将过期且足够热门，调用方应在后台预取刷新
+func (c *DNSCache) Get(group string, req *dns.Msg) (*dns.Msg, bool) {
+	if len(req.Question) == 0 {
+		return nil, false
+	}
+	key := cacheKey(group, req)
+	now := time.Now()
+
+	c.mu.Lock()
+	elem, ok := c.items[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !now.Before(entry.expireAt) {
+		// 过期条目在 serve-stale 窗口内保留，供上游故障时使用
+		if !now.Before(entry.expireAt.Add(c.maxStale)) {
+			c.removeElement(elem)
+		}
+		c.mu.Unlock()
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	entry.hits++
+
+	refresh := false
+	if c.prefetch && !entry.prefetching && entry.hits >= c.prefetchHits {
+		remaining := entry.expireAt.Sub(now)
+		if remaining <= time.Duration(entry.ttl*c.prefetchRatio)*time.Second/100 {
+			entry.prefetching = true
+			refresh = true
+		}
+	}
+	c.mu.Unlock()
+
+	return entry.reply(req, uint32(now.Sub(entry.storedAt)/time.Second)), refresh
+}
+
+// GetStale 在上游不可用时返回已过期但仍处于 serve-stale 窗口内的响应（RFC 8767），
+// 所有记录的 TTL 设置为 stale_ttl
+func (c *DNSCache) GetStale(group string, req *dns.Msg) *dns.Msg {
+	if c.maxStale == 0 || len(req.Question) == 0 {
+		return nil
+	}
+	now := time.Now()
+
+	c.mu.Lock()
+	elem, ok := c.items[cacheKey(group, req)]
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !now.Before(entry.expireAt.Add(c.maxStale)) {
+		c.removeElement(elem)
+		c.mu.Unlock()
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	c.mu.Unlock()
+
+	resp := entry.reply(req, 0)
+	forEachRR(resp, func(rr dns.RR) {
+		rr.Header().Ttl = min(rr.Header().Ttl, c.staleTTL)
+	})
+	return resp
+}
+
+// PrefetchFailed 在后台预取失败后清除预取标记，允许后续命中再次触发
+func (c *DNSCache) PrefetchFailed(group string, req *dns.Msg) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.items[cacheKey(group, req)]; ok {
+		elem.Value.(*cacheEntry).prefetching = false
+	}
+}
+
+// Set 将上游组 group 的响应写入缓存，仅缓存 NOERROR 与 NXDOMAIN 响应
+func (c *DNSCache) Set(group string, req *dns.Msg, resp *dns.Msg) {
+	if len(req.Question) == 0 || resp.Truncated {
+		return
+	}
+	if resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		return
+	}
+
+	msg := resp.Copy()
+	ttl, ok := c.normalizeTTL(msg)
+	if !ok || ttl == 0 {
+		return
+	}
+
+	now := time.Now()
+	c.store(&cacheEntry{
+		key:      cacheKey(group, req),
+		msg:      msg,
+		storedAt: now,
+		expireAt: now.Add(time.Duration(ttl) * time.Second),
+		ttl:      ttl,
+	})
+}
+
+// store 写入条目并按 LRU 淘汰超出容量的条目
+func (c *DNSCache) store(entry *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[entry.key]; ok {
+		// 保留热度，使刷新后的条目仍可继续预取
+		entry.hits = elem.Value.(*cacheEntry).hits
+		elem.Value = entry
+		c.lru.MoveToFront(elem)
+		return
+	}
+
+	c.items[entry.key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// removeElement 删除缓存条目，调用方需持有锁
+func (c *DNSCache) removeElement(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.items, elem.Value.(*cacheEntry).key)
+}
+
+// Len 返回缓存条目数量
+func (c *DNSCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// normalizeTTL 计算响应的缓存时长并将记录 TTL 限制在配置范围内。
+// 否定应答（NXDOMAIN/NODATA）按 RFC 2308 使用 SOA 的 TTL 与 MINIMUM 中较小者，
+// 没有 SOA 的否定应答不缓存
+func (c *DNSCache) normalizeTTL(msg *dns.Msg) (uint32, bool) {
+	if msg.Rcode == dns.RcodeNameError || len(msg.Answer) == 0 {
+		var soa *dns.SOA
+		for _, rr := range msg.Ns {
+			if s, ok := rr.(*dns.SOA); ok {
+				soa = s
+				break
+			}
+		}
+		if soa == nil {
+			return 0, false
+		}
+
+		ttl := min(soa.Hdr.Ttl, soa.Minttl)
+		ttl = min(max(ttl, c.minTTL), c.maxNeg)
+		forEachRR(msg, func(rr dns.RR) {
+			rr.Header().Ttl = min(rr.Header().Ttl, ttl)
+		})
+		soa.Hdr.Ttl = ttl
+		return ttl, true
+	}
+
+	var ttl uint32
+	first := true
+	forEachRR(msg, func(rr dns.RR) {
+		hdr := rr.Header()
+		hdr.Ttl = min(max(hdr.Ttl, c.minTTL), c.maxTTL)
+		if first || hdr.Ttl < ttl {
+			ttl = hdr.Ttl
+			first = false
+		}
+	})
+	return ttl, true
+}
+
+// reply 基于缓存条目为请求生成响应，TTL 扣减 elapsed 秒
+func (e *cacheEntry) reply(req *dns.Msg, elapsed uint32) *dns.Msg {
+	resp := replyFor(e.msg, req)
+
+	forEachRR(resp, func(rr dns.RR) {
+		hdr := rr.Header()
+		if hdr.Ttl > elapsed {
+			hdr.Ttl -= elapsed
+		} else {
+			hdr.Ttl = 0
+		}
+	})
+
+	return resp
+}
+
+// replyFor 复制响应并改写为对指定请求的应答：使用请求的消息 ID 与问题（保留客户端的大小写），
+// 客户端未使用 EDNS0 时去掉 OPT 记录
+func replyFor(msg *dns.Msg, req *dns.Msg) *dns.Msg {
+	resp := msg.Copy()
+	resp.Id = req.Id
+	resp.Question = append([]dns.Question(nil), req.Question...)
+
+	if req.IsEdns0() == nil {
+		extra := resp.Extra[:0]
+		for _, rr := range resp.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		resp.Extra = extra
+	}
+
+	return resp
+}
+
+// forEachRR 遍历响应中除 OPT 以外的所有资源记录
+func forEachRR(msg *dns.Msg, fn func(rr dns.RR)) {
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			fn(rr)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// 缓存快照文件格式：
+//
+//	magic "D2DC" | version uint8 | count uint32
+//	重复 count 次：keyLen uint16 | key | storedAt int64 | expireAt int64 | ttl uint32 | msgLen uint16 | msg（压缩的 DNS wire 格式）
+//
+// 所有整数均为大端序，时间为 Unix 秒
+// 版本 2 的缓存键包含上游组名称，版本 1 的快照不再加载
+const (
+	snapshotMagic   = "D2DC"
+	snapshotVersion = 2
+)
+
+const defaultSnapshotInterval = 300
+
+// SaveSnapshot 将缓存写入快照文件，先写临时文件再重命名以保证原子性
+func (c *DNSCache) SaveSnapshot(path string) (int, error) {
+	c.mu.Lock()
+	entries := make([]*cacheEntry, 0, c.lru.Len())
+	// 从最久未使用的条目开始写入，加载时依次插入即可恢复 LRU 顺序
+	for elem := c.lru.Back(); elem != nil; elem = elem.Prev() {
+		entries = append(entries, elem.Value.(*cacheEntry))
+	}
+	c.mu.Unlock()
+
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return 0, fmt.Errorf("failed to create snapshot directory: %v", err)
+		}
+	}
+
+	tmpPath := path + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return 0, fmt.Errorf("failed to create snapshot file: %v", err)
+	}
+
+	count, err := writeSnapshot(file, entries)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return 0, fmt.Errorf("failed to write snapshot: %v", err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return 0, fmt.Errorf("failed to replace snapshot file: %v", err)
+	}
+	return count, nil
+}
+
+// writeSnapshot 序列化缓存条目，无法打包的条目被跳过
+func writeSnapshot(w io.Writer, entries []*cacheEntry) (int, error) {
+	type record struct {
+		entry  *cacheEntry
+		packed []byte
+	}
+
+	records := make([]record, 0, len(entries))
+	for _, entry := range entries {
+		msg := entry.msg.Copy()
+		msg.Compress = true
+		packed, err := msg.Pack()
+		if err != nil || len(packed) > 0xFFFF || len(entry.key) > 0xFFFF {
+			continue
+		}
+		records = append(records, record{entry: entry, packed: packed})
+	}
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(snapshotMagic)
+	bw.WriteByte(snapshotVersion)
+	binary.Write(bw, binary.BigEndian, uint32(len(records)))
+
+	for _, rec := range records {
+		binary.Write(bw, binary.BigEndian, uint16(len(rec.entry.key)))
+		bw.WriteString(rec.entry.key)
+		binary.Write(bw, binary.BigEndian, rec.entry.storedAt.Unix())
+		binary.Write(bw, binary.BigEndian, rec.entry.expireAt.Unix())
+		binary.Write(bw, binary.BigEndian, rec.entry.ttl)
+		binary.Write(bw, binary.BigEndian, uint16(len(rec.packed)))
+		bw.Write(rec.packed)
+	}
+
+	return len(records), bw.Flush()
+}
+
+// LoadSnapshot 从快照文件恢复缓存。已过期且超出 serve-stale 窗口的条目被丢弃，
+// 已过期但仍在窗口内的条目仅用于 serve-stale
+func (c *DNSCache) LoadSnapshot(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to open snapshot file: %v", err)
+	}
+	defer file.Close()
+
+	br := bufio.NewReader(file)
+
+	header := make([]byte, len(snapshotMagic)+1)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return 0, fmt.Errorf("failed to read snapshot header: %v", err)
+	}
+	if string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return 0, fmt.Errorf("invalid snapshot file")
+	}
+	if header[len(snapshotMagic)] != snapshotVersion {
+		return 0, fmt.Errorf("unsupported snapshot version: %d", header[len(snapshotMagic)])
+	}
+
+	var count uint32
+	if err := binary.Read(br, binary.BigEndian, &count); err != nil {
+		return 0, fmt.Errorf("failed to read snapshot header: %v", err)
+	}
+
+	now := time.Now()
+	loaded := 0
+	for i := uint32(0); i < count; i++ {
+		entry, err := readSnapshotEntry(br)
+		if err != nil {
+			return loaded, fmt.Errorf("failed to read snapshot entry %d: %v", i, err)
+		}
+		if !now.Before(entry.expireAt.Add(c.maxStale)) {
+			continue
+		}
+		c.store(entry)
+		loaded++
+	}
+
+	return loaded, nil
+}
+
+// readSnapshotEntry 读取单个快照条目
+func readSnapshotEntry(r io.Reader) (*cacheEntry, error) {
+	var keyLen uint16
+	if err := binary.Read(r, binary.BigEndian, &keyLen); err != nil {
+		return nil, err
+	}
+	key := make([]byte, keyLen)
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, err
+	}
+
+	var storedAt, expireAt int64
+	var ttl uint32
+	var msgLen uint16
+	for _, v := range []any{&storedAt, &expireAt, &ttl, &msgLen} {
+		if err := binary.Read(r, binary.BigEndian, v); err != nil {
+			return nil, err
+		}
+	}
+
+	packed := make([]byte, msgLen)
+	if _, err := io.ReadFull(r, packed); err != nil {
+		return nil, err
+	}
+	msg := new(dns.Msg)
+	if err := msg.Unpack(packed); err != nil {
+		return nil, err
+	}
+	msg.Compress = false
+
+	return &cacheEntry{
+		key:      string(key),
+		msg:      msg,
+		storedAt: time.Unix(storedAt, 0),
+		expireAt: time.Unix(expireAt, 0),
+		ttl:      ttl,
+	}, nil
+}
+
+// runSnapshots 定期保存缓存快照，直到 stop 被关闭
+func (c *DNSCache) runSnapshots(path string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := c.SaveSnapshot(path); err != nil {
+				log.Printf("Failed to save cache snapshot: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
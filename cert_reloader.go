@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval 检查证书文件是否变化的最短间隔
+const certCheckInterval = 10 * time.Second
+
+// certReloader 为入站 TLS 监听提供证书，证书或私钥文件修改后自动重新加载，
+// 更新证书（如 ACME 续期）无需重启服务
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	certMod   time.Time
+	keyMod    time.Time
+	checkedAt time.Time
+}
+
+// newCertReloader 加载证书与私钥，文件无效时返回错误
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("cert_file and key_file are required")
+	}
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load 读取证书与私钥并记录文件修改时间，调用方需持有锁或独占访问
+func (r *certReloader) load() error {
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %v", err)
+	}
+	r.cert = &cert
+	r.certMod, r.keyMod = certMod, keyMod
+	r.checkedAt = time.Now()
+	return nil
+}
+
+// modTimes 返回证书与私钥文件的修改时间
+func (r *certReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("failed to read certificate: %v", err)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("failed to read private key: %v", err)
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// getCertificate 用作 tls.Config.GetCertificate。距上次检查超过 certCheckInterval 时检查文件修改时间，
+// 文件变化后重新加载；加载失败（如证书与私钥尚未同时更新）时继续使用当前证书
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checkedAt) < certCheckInterval {
+		return r.cert, nil
+	}
+	r.checkedAt = time.Now()
+
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		log.Printf("[WARNING] Certificate %s: %v, keeping the current certificate", r.certFile, err)
+		return r.cert, nil
+	}
+	if certMod.Equal(r.certMod) && keyMod.Equal(r.keyMod) {
+		return r.cert, nil
+	}
+	if err := r.load(); err != nil {
+		log.Printf("[WARNING] Certificate %s: %v, keeping the current certificate", r.certFile, err)
+		return r.cert, nil
+	}
+	log.Printf("Reloaded certificate %s", r.certFile)
+	return r.cert, nil
+}
+
+// tlsConfig 返回使用该证书的服务器 TLS 配置
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{GetCertificate: r.getCertificate, MinVersion: tls.VersionTLS12}
+}
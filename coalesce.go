@@ -0,0 +1,62 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// inflightQuery 正在进行的上游查询
+type inflightQuery struct {
+	done   chan struct{}
+	resp   *dns.Msg
+	server string
+	err    error
+	// 等待该查询结果的其他请求数量
+	waiters int
+}
+
+// queryCoalescer 合并发往同一上游组的相同问题（名称、类型、类别、DO 位与 ECS 子网）的并发查询，
+// 只有第一个请求发送到上游，其余请求等待并共享其结果
+type queryCoalescer struct {
+	mu       sync.Mutex
+	inflight map[string]*inflightQuery
+}
+
+// newQueryCoalescer 创建查询合并器
+func newQueryCoalescer() *queryCoalescer {
+	return &queryCoalescer{inflight: make(map[string]*inflightQuery)}
+}
+
+// do 执行查询或等待相同问题的进行中查询。返回的响应已复制并改写为对 req 的应答，
+// shared 表示结果来自其他请求发起的查询
+func (c *queryCoalescer) do(key string, req *dns.Msg, query func() (*dns.Msg, string, error)) (resp *dns.Msg, server string, shared bool, err error) {
+	c.mu.Lock()
+	if call, ok := c.inflight[key]; ok {
+		call.waiters++
+		c.mu.Unlock()
+
+		<-call.done
+		if call.err != nil {
+			return nil, call.server, true, call.err
+		}
+		return replyFor(call.resp, req), call.server, true, nil
+	}
+	call := &inflightQuery{done: make(chan struct{})}
+	c.inflight[key] = call
+	c.mu.Unlock()
+
+	call.resp, call.server, call.err = query()
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	waiters := call.waiters
+	c.mu.Unlock()
+	close(call.done)
+
+	if call.err != nil || waiters == 0 {
+		return call.resp, call.server, false, call.err
+	}
+	// 等待者会复制 call.resp，发起者同样使用副本以免修改共享的响应
+	return replyFor(call.resp, req), call.server, false, nil
+}
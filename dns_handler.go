@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"time"
 
 	"github.com/miekg/dns"
@@ -11,55 +13,164 @@ import (
 
 // DNSServer DNS 服务器结构体
 type DNSServer struct {
-	config      *Config
-	dohClient   *DoHClient
-	server      *dns.Server
+	config    *Config
+	dohClient *DoHClient
+	cache     *DNSCache
+	coalescer *queryCoalescer
+	// 全局客户端访问控制列表，监听可单独覆盖
+	acl         *accessList
+	limiter     *rateLimiter
+	servers     []*dns.Server
+	httpServers []*http.Server
 	queryLogger QueryLogger
+	stopChan    chan struct{}
 }
 
-// NewDNSServer 创建新的 DNS 服务器实例
-func NewDNSServer(config *Config, dohClient *DoHClient, queryLogger QueryLogger) *DNSServer {
+// NewDNSServer 创建新的 DNS 服务器实例，cache 为 nil 时不使用缓存
+func NewDNSServer(config *Config, dohClient *DoHClient, cache *DNSCache, queryLogger QueryLogger) *DNSServer {
 	return &DNSServer{
 		config:      config,
 		dohClient:   dohClient,
+		cache:       cache,
+		coalescer:   newQueryCoalescer(),
 		queryLogger: queryLogger,
 	}
 }
 
-// Start 启动 DNS 服务器
+// Start 启动所有监听。任一监听启动失败时停止已启动的监听并返回错误
 func (s *DNSServer) Start() error {
-	// 创建 UDP 服务器
-	s.server = &dns.Server{
-		Addr: s.config.Server.Listen,
-		Net:  "udp",
+	acl, err := newAccessList(s.config.Server.AccessControl)
+	if err != nil {
+		return err
+	}
+	s.acl = acl
+
+	if s.limiter, err = newRateLimiter(s.config.Server.RateLimit); err != nil {
+		return err
+	}
+	if s.limiter != nil {
+		interval := s.config.Server.RateLimit.StatsInterval
+		if interval == 0 {
+			interval = defaultRateLimitStatsInterval
+		}
+		s.limiter.start(time.Duration(interval) * time.Second)
+		log.Printf("Rate limiting: %s", s.limiter)
+	}
+
+	s.startCacheSnapshots()
+
+	for _, cfg := range listenerConfigs(s.config) {
+		l, err := s.newListener(cfg)
+		if err == nil {
+			err = s.startListener(l)
+		}
+		if err != nil {
+			s.Stop()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// startServer 在后台启动服务器，并等待其完成监听或返回绑定错误
+func (s *DNSServer) startServer(server *dns.Server) error {
+	started := make(chan struct{})
+	errChan := make(chan error, 1)
+	server.NotifyStartedFunc = func() { close(started) }
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil {
+			errChan <- err
+		}
+		close(errChan)
+	}()
+
+	select {
+	case <-started:
+	case err, ok := <-errChan:
+		if !ok {
+			err = fmt.Errorf("server exited before listening")
+		}
+		return fmt.Errorf("failed to listen on %s/%s: %v", server.Net, server.Addr, err)
 	}
 
-	// 设置 DNS 查询处理器
-	dns.HandleFunc(".", s.handleDNSRequest)
+	s.servers = append(s.servers, server)
 
-	// 启动服务器
-	log.Printf("UDP DNS server listening on %s", s.config.Server.Listen)
+	// 监听成功后的运行期错误仅记录日志
 	go func() {
-		if err := s.server.ListenAndServe(); err != nil {
-			log.Fatalf("DNS server error: %v", err)
+		if err, ok := <-errChan; ok {
+			log.Printf("DNS server (%s/%s) error: %v", server.Net, server.Addr, err)
 		}
 	}()
 
 	return nil
 }
 
+// startCacheSnapshots 从快照恢复缓存并启动定期保存
+func (s *DNSServer) startCacheSnapshots() {
+	path := s.config.Cache.SnapshotPath
+	if s.cache == nil || path == "" {
+		return
+	}
+
+	if n, err := s.cache.LoadSnapshot(path); err != nil {
+		log.Printf("Failed to load cache snapshot: %v", err)
+	} else {
+		log.Printf("Loaded %d cache entries from %s", n, path)
+	}
+
+	interval := s.config.Cache.SnapshotInterval
+	if interval == 0 {
+		interval = defaultSnapshotInterval
+	}
+	s.stopChan = make(chan struct{})
+	if interval > 0 {
+		go s.cache.runSnapshots(path, time.Duration(interval)*time.Second, s.stopChan)
+	}
+}
+
 // Stop 停止 DNS 服务器
 func (s *DNSServer) Stop() error {
-	if s.server != nil {
-		return s.server.Shutdown()
+	var firstErr error
+	for _, server := range s.servers {
+		if err := server.Shutdown(); err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
-	return nil
+	s.servers = nil
+	for _, server := range s.httpServers {
+		ctx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+		if err := server.Shutdown(ctx); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		cancel()
+	}
+	s.httpServers = nil
+	if s.limiter != nil {
+		s.limiter.close()
+	}
+
+	// 停止定期保存并写入最终快照
+	if s.stopChan != nil {
+		close(s.stopChan)
+		s.stopChan = nil
+		path := s.config.Cache.SnapshotPath
+		if n, err := s.cache.SaveSnapshot(path); err != nil {
+			log.Printf("Failed to save cache snapshot: %v", err)
+		} else {
+			log.Printf("Saved %d cache entries to %s", n, path)
+		}
+	}
+
+	return firstErr
 }
 
-// handleDNSRequest 处理 DNS 查询请求
-func (s *DNSServer) handleDNSRequest(w dns.ResponseWriter, req *dns.Msg) {
+// handleDNSRequest 按监听 l 的策略处理 DNS 查询请求
+func (s *DNSServer) handleDNSRequest(l *listener, w dns.ResponseWriter, req *dns.Msg) {
 	startTime := time.Now()
 	clientAddr := w.RemoteAddr().String()
+	transport := queryTransport(w)
 
 	var domain string
 	var queryType string
@@ -73,6 +184,42 @@ func (s *DNSServer) handleDNSRequest(w dns.ResponseWriter, req *dns.Msg) {
 	resp.SetReply(req)
 	resp.Compress = false
 
+	// 访问控制在任何上游查询之前执行
+	if !l.acl.permits(remoteIP(w.RemoteAddr())) {
+		code := aclRefusedCode
+		if l.acl.drop {
+			code = aclDroppedCode
+		} else {
+			resp.SetRcode(req, dns.RcodeRefused)
+			w.WriteMsg(resp)
+		}
+		if s.config.Logging.Level == "debug" {
+			log.Printf("Query for %s from %s denied by access control (%s)", domain, clientAddr, code)
+		}
+		s.logQuery(l, QueryLogEntry{
+			Timestamp:    startTime,
+			ClientIP:     clientAddr,
+			Domain:       domain,
+			QueryType:    queryType,
+			ResponseCode: code,
+			Duration:     time.Since(startTime).Milliseconds(),
+			Transport:    transport,
+		})
+		return
+	}
+
+	// 超出客户端查询速率时不查询上游：DoH 返回 HTTP 429，其他传输协议不响应。
+	// 被限速的查询只计数、不写查询日志，避免洪水查询变成同等数量的文件或数据库写入
+	if !s.limiter.allowQuery(remoteIP(w.RemoteAddr())) {
+		if dw, ok := w.(*dohResponseWriter); ok {
+			dw.reject(http.StatusTooManyRequests)
+		}
+		if s.config.Logging.Level == "debug" {
+			log.Printf("Query for %s from %s rate limited", domain, clientAddr)
+		}
+		return
+	}
+
 	// 检查是否有查询问题
 	if len(req.Question) == 0 {
 		resp.SetRcode(req, dns.RcodeFormatError)
@@ -80,8 +227,18 @@ func (s *DNSServer) handleDNSRequest(w dns.ResponseWriter, req *dns.Msg) {
 		return
 	}
 
-	// 通过 DoH 查询 DNS
-	dohResp, dohServer, err := s.dohClient.QueryWithServer(req)
+	// 按域名匹配路由规则，未匹配时使用监听指定的上游组，查询缓存或通过上游组查询 DNS
+	rule := s.dohClient.Route(domain)
+	if rule == nil {
+		rule = l.fallback
+	}
+	var ruleName string
+	if rule != nil {
+		ruleName = rule.name
+	}
+	// 按上游组的 ECS 策略改写查询，缓存与上游查询均使用改写后的查询
+	query := s.dohClient.ApplyECS(rule, req, newECSClient(w.RemoteAddr(), req))
+	dohResp, dohServer, err := s.resolve(query, rule)
 	queryDuration := time.Since(startTime)
 
 	if err != nil {
@@ -90,7 +247,7 @@ func (s *DNSServer) handleDNSRequest(w dns.ResponseWriter, req *dns.Msg) {
 		w.WriteMsg(resp)
 
 		// Log failed query
-		s.queryLogger.Log(QueryLogEntry{
+		s.logQuery(l, QueryLogEntry{
 			Timestamp:    startTime,
 			ClientIP:     clientAddr,
 			Domain:       domain,
@@ -99,10 +256,27 @@ func (s *DNSServer) handleDNSRequest(w dns.ResponseWriter, req *dns.Msg) {
 			AnswerCount:  0,
 			Duration:     queryDuration.Milliseconds(),
 			DoHServer:    dohServer,
+			Rule:         ruleName,
+			Transport:    transport,
 		})
 		return
 	}
 
+	// UDP 响应执行 RRL，超出速率的相同响应被丢弃或以 TC=1 的空响应代替。
+	// 与被限速的查询相同，只计数、不写查询日志，避免每个反射数据包都变成一次文件或数据库写入
+	if transport == "udp" {
+		if rrl := s.limiter.limitResponse(remoteIP(w.RemoteAddr()), dohResp); rrl != rrlPass {
+			if s.config.Logging.Level == "debug" {
+				log.Printf("Response for %s to %s limited by RRL (%s)", domain, clientAddr, rrl)
+			}
+			if rrl == rrlSlip {
+				resp.Truncated = true
+				w.WriteMsg(resp)
+			}
+			return
+		}
+	}
+
 	// Extract answer details
 	answers := make([]AnswerEntry, 0, len(dohResp.Answer))
 	for _, ans := range dohResp.Answer {
@@ -137,7 +311,7 @@ func (s *DNSServer) handleDNSRequest(w dns.ResponseWriter, req *dns.Msg) {
 	}
 
 	// Log successful query with answers
-	s.queryLogger.Log(QueryLogEntry{
+	s.logQuery(l, QueryLogEntry{
 		Timestamp:    startTime,
 		ClientIP:     clientAddr,
 		Domain:       domain,
@@ -147,10 +321,12 @@ func (s *DNSServer) handleDNSRequest(w dns.ResponseWriter, req *dns.Msg) {
 		Answers:      answers,
 		Duration:     queryDuration.Milliseconds(),
 		DoHServer:    dohServer,
+		Rule:         ruleName,
+		Transport:    transport,
 	})
 
 	// Print detailed answer records if enabled
-	if s.config.Logging.QueryLog.Enabled && s.config.Logging.Level == "debug" {
+	if l.queryLog && s.config.Logging.QueryLog.Enabled && s.config.Logging.Level == "debug" {
 		for _, ans := range dohResp.Answer {
 			switch rr := ans.(type) {
 			case *dns.A:
@@ -169,12 +345,124 @@ func (s *DNSServer) handleDNSRequest(w dns.ResponseWriter, req *dns.Msg) {
 		}
 	}
 
+	// 去掉客户端未请求的 OPT 记录与 ECS 选项，并按客户端 UDP 缓冲区大小截断响应
+	restoreClientEDNS(dohResp, req)
+	s.truncateResponse(w, req, dohResp)
+
 	// 发送响应
 	if err := w.WriteMsg(dohResp); err != nil {
 		log.Printf("Failed to send response: %v", err)
 	}
 }
 
+// resolve 优先从缓存应答，未命中时通过规则对应的上游组查询并写入缓存；
+// 上游全部失败时尝试使用过期缓存应答（serve-stale）
+func (s *DNSServer) resolve(req *dns.Msg, rule *routeRule) (*dns.Msg, string, error) {
+	group := s.dohClient.routeGroup(rule).name
+	if s.cache != nil {
+		if resp, refresh := s.cache.Get(group, req); resp != nil {
+			if refresh {
+				go s.prefetch(req.Copy(), rule)
+			}
+			return resp, "cache", nil
+		}
+	}
+
+	resp, server, err := s.query(req, rule)
+	if err != nil {
+		if s.cache != nil {
+			if stale := s.cache.GetStale(group, req); stale != nil {
+				log.Printf("Serving stale answer for %s: %v", req.Question[0].Name, err)
+				return stale, "cache (stale)", nil
+			}
+		}
+		return nil, server, err
+	}
+	return resp, server, nil
+}
+
+// query 通过路由规则对应的上游组查询并写入缓存，rule 为 nil 时使用默认上游组。
+// 发往同一上游组的相同问题的并发查询合并为一次上游查询，每个请求得到使用自己消息 ID 的响应
+func (s *DNSServer) query(req *dns.Msg, rule *routeRule) (*dns.Msg, string, error) {
+	group := s.dohClient.routeGroup(rule).name
+	resp, server, shared, err := s.coalescer.do(cacheKey(group, req), req, func() (*dns.Msg, string, error) {
+		if rule != nil && s.config.Logging.Level == "debug" {
+			if rule.name != "" {
+				log.Printf("Routing %s via rule %s to upstream group %s", req.Question[0].Name, rule.name, rule.group.name)
+			} else {
+				log.Printf("Routing %s to listener upstream group %s", req.Question[0].Name, rule.group.name)
+			}
+		}
+		resp, server, err := s.dohClient.QueryRoute(rule, req)
+		if err == nil && s.cache != nil {
+			s.cache.Set(group, req, resp)
+		}
+		return resp, server, err
+	})
+	if shared && s.config.Logging.Level == "debug" {
+		log.Printf("Coalesced query for %s (type: %s) with an in-flight upstream query", req.Question[0].Name, dns.TypeToString[req.Question[0].Qtype])
+	}
+	return resp, server, err
+}
+
+// prefetch 在后台刷新即将过期的热门缓存条目
+func (s *DNSServer) prefetch(req *dns.Msg, rule *routeRule) {
+	_, server, err := s.query(req, rule)
+	if err != nil {
+		s.cache.PrefetchFailed(s.dohClient.routeGroup(rule).name, req)
+		if s.config.Logging.Level == "debug" {
+			log.Printf("Prefetch for %s failed: %v", req.Question[0].Name, err)
+		}
+		return
+	}
+
+	if s.config.Logging.Level == "debug" {
+		log.Printf("Prefetched %s (type: %s) from %s", req.Question[0].Name, dns.TypeToString[req.Question[0].Qtype], server)
+	}
+}
+
+// logQuery 记录查询日志，监听策略关闭了查询日志时跳过
+func (s *DNSServer) logQuery(l *listener, entry QueryLogEntry) {
+	if l.queryLog {
+		s.queryLogger.Log(entry)
+	}
+}
+
+// queryTransport 返回查询到达的传输协议：udp、tcp、tls（DNS-over-TLS）或 https（DNS-over-HTTPS）
+func queryTransport(w dns.ResponseWriter) string {
+	if _, ok := w.(*dohResponseWriter); ok {
+		return "https"
+	}
+	if cs, ok := w.(dns.ConnectionStater); ok && cs.ConnectionState() != nil {
+		return "tls"
+	}
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		return "udp"
+	}
+	return "tcp"
+}
+
+// truncateResponse 对 UDP 客户端按其 EDNS0 缓冲区大小（无 EDNS0 时为 512 字节）截断响应，
+// 超出时设置 TC 位，使客户端改用 TCP 重试
+func (s *DNSServer) truncateResponse(w dns.ResponseWriter, req *dns.Msg, resp *dns.Msg) {
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); !ok {
+		return
+	}
+
+	size := dns.MinMsgSize
+	if opt := req.IsEdns0(); opt != nil {
+		size = int(opt.UDPSize())
+	}
+	if maxSize := s.config.Server.MaxUDPSize; maxSize > 0 && size > maxSize {
+		size = maxSize
+	}
+
+	resp.Truncate(size)
+	if resp.Truncated && s.config.Logging.Level == "debug" {
+		log.Printf("Response for %s truncated to %d bytes (client buffer size)", req.Question[0].Name, size)
+	}
+}
+
 // validateIPAddress 验证 IP 地址格式
 func validateIPAddress(addr string) error {
 	host, _, err := net.SplitHostPort(addr)
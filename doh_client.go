@@ -3,105 +3,529 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
 	"golang.org/x/net/http2"
 )
 
+// HTTP 版本
+const (
+	httpVersion11 = "1.1"
+	httpVersion2  = "2"
+	httpVersion3  = "3"
+)
+
+const (
+	defaultUserAgent = "Dns2DoH/1.0"
+	// defaultUpstreamGroup 为 doh.servers 对应的上游组名称，也是未配置 routing.default 时的默认组
+	defaultUpstreamGroup = "default"
+)
+
+// dnsTransport 非 HTTPS 上游传输（DoT、DoQ、明文 DNS）
+type dnsTransport interface {
+	exchange(ctx context.Context, packed []byte) (*dns.Msg, error)
+	close()
+}
+
 // DoHClient DoH 客户端结构体
 type DoHClient struct {
 	config     *Config
-	httpClient *http.Client
 	tlsManager *TLSConfigManager
+	// 按 HTTP 版本与代理区分的客户端，见 clientKey
+	httpClients map[string]*http.Client
+	http3       http3State
+	// 按服务器 URL 与代理区分的非 HTTPS 传输，见 clientKey
+	transports map[string]dnsTransport
+	// 解析上游服务器主机名
+	bootstrap *bootstrapResolver
+	// 按代理 URL 区分的拨号函数
+	proxyDials map[string]dialFunc
+	// 按名称区分的上游组，groupOrder 保持创建顺序
+	groups     map[string]*upstreamGroup
+	groupOrder []*upstreamGroup
+	// 未匹配任何路由规则时使用的上游组
+	defaultGroup *upstreamGroup
+	router       *router
+	health       *healthChecker
+	// 全局 ECS 策略，上游组可单独覆盖
+	ecs *ecsPolicy
 }
 
 // NewDoHClient 创建新的 DoH 客户端
-func NewDoHClient(config *Config, tlsManager *TLSConfigManager) *DoHClient {
-	// 创建 HTTP 客户端
+func NewDoHClient(config *Config, tlsManager *TLSConfigManager) (*DoHClient, error) {
+	client := &DoHClient{
+		config:      config,
+		tlsManager:  tlsManager,
+		httpClients: make(map[string]*http.Client),
+		http3: http3State{
+			brokenUntil: make(map[string]time.Time),
+			discovered:  make(map[string]bool),
+		},
+		transports: make(map[string]dnsTransport),
+		groups:     make(map[string]*upstreamGroup),
+		bootstrap:  newBootstrapResolver(config),
+		proxyDials: make(map[string]dialFunc),
+	}
+
+	ecs, err := newECSPolicy(config.ECS)
+	if err != nil {
+		return nil, err
+	}
+	client.ecs = ecs
+
+	// 为每个 HTTP 版本创建直连客户端（连接按需建立），经代理的客户端在 prepareServers 中创建
+	for _, version := range []string{httpVersion11, httpVersion2} {
+		client.httpClients[version] = client.newHTTPClient(version, client.bootstrap.dial)
+	}
+	client.httpClients[httpVersion3] = client.newHTTP3Client()
+
+	// doh.servers 作为名为 default 的上游组，其余上游组按名称排序创建
+	if len(config.DoH.Servers) > 0 {
+		if _, ok := config.Upstreams[defaultUpstreamGroup]; ok {
+			return nil, fmt.Errorf("doh.servers conflicts with upstream group %q, move the servers into upstreams", defaultUpstreamGroup)
+		}
+		if _, err := client.newUpstreamGroup(defaultUpstreamGroup, UpstreamGroupConfig{
+			Servers:  config.DoH.Servers,
+			Strategy: config.DoH.Strategy,
+			Parallel: config.DoH.Parallel,
+		}); err != nil {
+			return nil, fmt.Errorf("upstream group %s: %v", defaultUpstreamGroup, err)
+		}
+	}
+	names := make([]string, 0, len(config.Upstreams))
+	for name := range config.Upstreams {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if len(config.Upstreams[name].Servers) == 0 {
+			return nil, fmt.Errorf("upstream group %q has no servers", name)
+		}
+		if _, err := client.newUpstreamGroup(name, config.Upstreams[name]); err != nil {
+			return nil, fmt.Errorf("upstream group %s: %v", name, err)
+		}
+	}
+
+	defaultName := config.Routing.Default
+	if defaultName == "" {
+		defaultName = defaultUpstreamGroup
+	}
+	var ok bool
+	if client.defaultGroup, ok = client.groups[defaultName]; !ok {
+		return nil, fmt.Errorf("default upstream group %q is not configured", defaultName)
+	}
+
+	router, err := newRouter(client)
+	if err != nil {
+		return nil, err
+	}
+	client.router = router
+
+	// 启动主动健康检查
+	if config.DoH.HealthCheck.Enabled {
+		client.health = newHealthChecker(client)
+		client.health.Start()
+	}
+
+	return client, nil
+}
+
+// newUpstreamGroup 创建上游组并按名称注册。条件转发规则的内联服务器组同样注册，可被监听的 policy.upstream 引用，
+// 名称已被其他上游组占用时返回错误。上游组的 ECS 配置无效时返回错误（与全局 ECS 配置相同），避免误配置时向上游泄露客户端子网
+func (c *DoHClient) newUpstreamGroup(name string, cfg UpstreamGroupConfig) (*upstreamGroup, error) {
+	if _, ok := c.groups[name]; ok {
+		return nil, fmt.Errorf("upstream group name %q is already in use", name)
+	}
+	group := &upstreamGroup{
+		name:     name,
+		selector: newUpstreamSelector(cfg.Strategy, cfg.Parallel, c.prepareServers(cfg.Servers), newBreakerSettings(c.config)),
+		ecs:      c.ecs,
+	}
+	if cfg.ECS != nil {
+		policy, err := newECSPolicy(*cfg.ECS)
+		if err != nil {
+			return nil, err
+		}
+		group.ecs = policy
+	}
+	c.groups[name] = group
+	c.groupOrder = append(c.groupOrder, group)
+	return group, nil
+}
+
+// prepareServers 解析服务器的 HTTP 版本与消息格式，并为非 HTTPS 服务器创建传输
+func (c *DoHClient) prepareServers(configs []DoHServerConfig) []DoHServerConfig {
+	servers := make([]DoHServerConfig, 0, len(configs))
+	for _, server := range configs {
+		if server.Name == "" {
+			server.Name = server.URL
+		}
+		server.HTTPVersion = c.httpVersion(&server)
+		server.Format = messageFormat(&server)
+		c.bootstrap.addServerIPs(&server)
+
+		// 服务器未配置代理时使用全局代理，direct 表示直连
+		if server.Proxy == "" {
+			server.Proxy = c.config.DoH.Proxy
+		}
+		if server.Proxy == proxyDirect {
+			server.Proxy = ""
+		}
+		dial := c.bootstrap.dial
+		if server.Proxy != "" {
+			dial = c.proxyDial(server.Proxy)
+			switch {
+			case strings.HasPrefix(server.URL, schemeDoQ), strings.HasPrefix(server.URL, schemeUDP):
+				log.Printf("[WARNING] Upstream %s: proxies only apply to TCP-based transports, connecting directly", server.Name)
+				server.Proxy = ""
+			case server.HTTPVersion == httpVersion3:
+				log.Printf("[WARNING] Upstream %s: HTTP/3 cannot be used through a proxy, using HTTP/2", server.Name)
+				server.HTTPVersion = httpVersion2
+			}
+		}
+		servers = append(servers, server)
+
+		if server.Proxy != "" && (strings.HasPrefix(server.URL, "https://") || strings.HasPrefix(server.URL, "http://")) {
+			for _, version := range []string{httpVersion11, httpVersion2} {
+				key := clientKey(version, server.Proxy)
+				if _, ok := c.httpClients[key]; !ok {
+					c.httpClients[key] = c.newHTTPClient(version, dial)
+				}
+			}
+			continue
+		}
+
+		key := clientKey(server.URL, server.Proxy)
+		if _, ok := c.transports[key]; ok {
+			continue
+		}
+
+		// DNS-over-TLS、DNS-over-QUIC 与明文 DNS 服务器
+		var transport dnsTransport
+		var err error
+		switch {
+		case strings.HasPrefix(server.URL, schemeDoT):
+			transport, err = newDoTTransport(server.URL, c.tlsManager.GetTLSConfig(), dial)
+		case strings.HasPrefix(server.URL, schemeDoQ):
+			transport, err = newDoQTransport(server.URL, c.tlsManager.GetTLSConfig(), c.bootstrap)
+		case strings.HasPrefix(server.URL, schemeUDP):
+			transport, err = newPlainTransport(server.URL, c.bootstrap, nil)
+		case strings.HasPrefix(server.URL, schemeTCP):
+			var proxied dialFunc
+			if server.Proxy != "" {
+				proxied = dial
+			}
+			transport, err = newPlainTransport(server.URL, c.bootstrap, proxied)
+		default:
+			continue
+		}
+		if err != nil {
+			log.Printf("[WARNING] Upstream %s: %v", server.Name, err)
+			continue
+		}
+		c.transports[key] = transport
+	}
+	return servers
+}
+
+// proxyDial 返回代理的拨号函数。代理配置无效时返回的函数总是失败，使相关服务器的查询报告该错误
+func (c *DoHClient) proxyDial(proxyURL string) dialFunc {
+	if dial, ok := c.proxyDials[proxyURL]; ok {
+		return dial
+	}
+	dial, err := newProxyDial(proxyURL, c.bootstrap)
+	if err != nil {
+		log.Printf("[WARNING] Proxy %s: %v", redactProxyURL(proxyURL), err)
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, err
+		}
+	} else {
+		log.Printf("Using proxy %s", redactProxyURL(proxyURL))
+	}
+	c.proxyDials[proxyURL] = dial
+	return dial
+}
+
+// clientKey 返回 HTTP 客户端或传输的索引键，经代理时附加代理 URL
+func clientKey(name, proxyURL string) string {
+	if proxyURL == "" {
+		return name
+	}
+	return name + " via " + proxyURL
+}
+
+// newHTTPClient 创建指定 HTTP 版本的客户端，超时由每次请求的 context 控制
+func (c *DoHClient) newHTTPClient(version string, dial dialFunc) *http.Client {
 	transport := &http.Transport{
-		TLSClientConfig:     tlsManager.GetTLSConfig(),
+		TLSClientConfig:     c.tlsManager.GetTLSConfig(),
+		DialContext:         dial,
 		MaxIdleConns:        100,
 		MaxIdleConnsPerHost: 10,
 		IdleConnTimeout:     90 * time.Second,
 	}
 
-	// 如果配置启用 HTTP/2
-	if config.DoH.UseHTTP2 {
+	// 配置 HTTP/2
+	if version == httpVersion2 {
 		if err := http2.ConfigureTransport(transport); err != nil {
 			log.Printf("Failed to configure HTTP/2: %v, using HTTP/1.1", err)
 		}
 	}
 
-	httpClient := &http.Client{
-		Transport: transport,
-		Timeout:   time.Duration(config.DoH.Timeout) * time.Second,
+	return &http.Client{Transport: transport}
+}
+
+// defaultHTTPVersion 返回全局默认的 HTTP 版本
+func (c *DoHClient) defaultHTTPVersion() string {
+	if c.config.DoH.UseHTTP3 {
+		return httpVersion3
+	}
+	if c.config.DoH.UseHTTP2 {
+		return httpVersion2
 	}
+	return httpVersion11
+}
 
-	return &DoHClient{
-		config:     config,
-		httpClient: httpClient,
-		tlsManager: tlsManager,
+// httpVersion 解析服务器配置的 HTTP 版本，未配置时使用全局默认值
+func (c *DoHClient) httpVersion(server *DoHServerConfig) string {
+	switch server.HTTPVersion {
+	case "":
+		return c.defaultHTTPVersion()
+	case "1", "1.1", "http/1.1":
+		return httpVersion11
+	case "2", "h2":
+		return httpVersion2
+	case "3", "h3":
+		return httpVersion3
+	default:
+		log.Printf("[WARNING] DoH server %s: unsupported http_version %q, using %s",
+			server.Name, server.HTTPVersion, c.defaultHTTPVersion())
+		return c.defaultHTTPVersion()
 	}
 }
 
+// timeout 返回服务器的查询超时时间
+func (c *DoHClient) timeout(server *DoHServerConfig) time.Duration {
+	if server.Timeout > 0 {
+		return time.Duration(server.Timeout) * time.Second
+	}
+	return time.Duration(c.config.DoH.Timeout) * time.Second
+}
+
 // Query 通过 DoH 查询 DNS
 func (c *DoHClient) Query(req *dns.Msg) (*dns.Msg, error) {
 	resp, _, err := c.QueryWithServer(req)
 	return resp, err
 }
 
-// QueryWithServer 通过 DoH 查询 DNS 并返回使用的服务器
+// QueryWithServer 通过默认上游组查询 DNS 并返回使用的服务器
 func (c *DoHClient) QueryWithServer(req *dns.Msg) (*dns.Msg, string, error) {
+	return c.queryWith(c.defaultGroup.selector, req)
+}
+
+// Route 返回查询名称匹配的路由规则，未匹配时返回 nil
+func (c *DoHClient) Route(qname string) *routeRule {
+	return c.router.match(qname)
+}
+
+// ApplyECS 按路由规则对应上游组的 ECS 策略改写客户端查询，rule 为 nil 时使用默认上游组的策略。
+// 返回的查询用于缓存与上游查询，ECS 无需改变时直接返回 req
+func (c *DoHClient) ApplyECS(rule *routeRule, req *dns.Msg, client ecsClient) *dns.Msg {
+	return c.routeGroup(rule).ecs.apply(req, client)
+}
+
+// routeGroup 返回路由规则对应的上游组，rule 为 nil 时返回默认上游组
+func (c *DoHClient) routeGroup(rule *routeRule) *upstreamGroup {
+	if rule == nil {
+		return c.defaultGroup
+	}
+	return rule.group
+}
+
+// QueryRoute 通过路由规则的上游组查询 DNS 并返回使用的服务器，rule 为 nil 时使用默认上游组
+func (c *DoHClient) QueryRoute(rule *routeRule, req *dns.Msg) (*dns.Msg, string, error) {
+	if rule == nil {
+		return c.QueryWithServer(req)
+	}
+	return c.queryWith(rule.group.selector, req)
+}
+
+// outboundQuery 打包后的上游查询，padded 为填充后的版本，未启用填充时为 nil
+type outboundQuery struct {
+	packed []byte
+	padded []byte
+}
+
+// packet 返回发往指定服务器的查询，加密传输的服务器使用填充后的版本
+func (q *outboundQuery) packet(server *DoHServerConfig) []byte {
+	if q.padded != nil && isEncryptedServer(server) {
+		return q.padded
+	}
+	return q.packed
+}
+
+// queryWith 按选择器的策略依次查询上游组中的服务器
+func (c *DoHClient) queryWith(selector *upstreamSelector, req *dns.Msg) (*dns.Msg, string, error) {
 	// 将 DNS 消息打包为字节
-	packed, err := req.Pack()
+	var query outboundQuery
+	var err error
+	query.packed, err = req.Pack()
 	if err != nil {
 		return nil, "", fmt.Errorf("failed to pack DNS message: %v", err)
 	}
+	if block := paddingBlockSize(c.config); block > 0 {
+		msg := req.Copy()
+		padMessage(msg, block)
+		if query.padded, err = msg.Pack(); err != nil {
+			return nil, "", fmt.Errorf("failed to pack DNS message: %v", err)
+		}
+	}
+
+	upstreams := selector.order()
+	if len(upstreams) == 0 {
+		return nil, "", fmt.Errorf("no available DoH servers")
+	}
+
+	// parallel 策略：同时向前 N 个服务器发送查询，其余服务器作为后备
+	if selector.strategy == strategyParallel {
+		n := min(selector.parallel, len(upstreams))
 
-	// 尝试每个配置的 DoH 服务器
+		resp, server, err := c.queryParallel(upstreams[:n], &query)
+		if err == nil || n == len(upstreams) {
+			return resp, server, err
+		}
+		upstreams = upstreams[n:]
+	}
+
+	// 按顺序尝试每个 DoH 服务器
 	var lastErr error
-	for _, server := range c.config.DoH.Servers {
-		resp, err := c.queryServer(server.URL, packed)
+	for _, u := range upstreams {
+		resp, err := c.queryUpstream(context.Background(), u, query.packet(&u.config))
 		if err != nil {
 			lastErr = err
-			if c.config.Logging.Level == "debug" {
-				log.Printf("DoH server %s (%s) query failed: %v", server.Name, server.URL, err)
-			}
 			continue
 		}
-		return resp, server.Name, nil
+		return resp, u.config.Name, nil
 	}
 
 	// 所有服务器都失败
-	if lastErr != nil {
-		return nil, "", fmt.Errorf("all DoH servers failed, last error: %v", lastErr)
+	return nil, "", fmt.Errorf("all DoH servers failed, last error: %v", lastErr)
+}
+
+// queryParallel 并发查询多个服务器，返回第一个有效响应并取消其余请求
+func (c *DoHClient) queryParallel(upstreams []*upstream, query *outboundQuery) (*dns.Msg, string, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type result struct {
+		resp   *dns.Msg
+		server string
+		err    error
+	}
+	results := make(chan result, len(upstreams))
+
+	for _, u := range upstreams {
+		go func(u *upstream) {
+			resp, err := c.queryUpstream(ctx, u, query.packet(&u.config))
+			results <- result{resp: resp, server: u.config.Name, err: err}
+		}(u)
+	}
+
+	var lastErr error
+	for range upstreams {
+		r := <-results
+		if r.err == nil {
+			return r.resp, r.server, nil
+		}
+		lastErr = r.err
+	}
+	return nil, "", fmt.Errorf("all DoH servers failed, last error: %v", lastErr)
+}
+
+// queryUpstream 查询单个上游服务器并记录其 RTT
+func (c *DoHClient) queryUpstream(ctx context.Context, u *upstream, packed []byte) (*dns.Msg, error) {
+	start := time.Now()
+	resp, err := c.queryServer(ctx, &u.config, packed)
+	if err != nil {
+		// 被 parallel 策略取消的请求不计入失败
+		if ctx.Err() == nil {
+			u.recordFailure(c.timeout(&u.config))
+			if c.config.Logging.Level == "debug" {
+				log.Printf("DoH server %s (%s) query failed: %v", u.config.Name, u.config.URL, err)
+			}
+		}
+		return nil, err
+	}
+
+	u.recordSuccess(time.Since(start))
+	// 填充只用于加密链路，不缓存也不转发给客户端
+	if opt := resp.IsEdns0(); opt != nil {
+		removeEDNS0Option(opt, dns.EDNS0PADDING)
 	}
-	return nil, "", fmt.Errorf("no available DoH servers")
+	return resp, nil
 }
 
 // queryServer 向指定的 DoH 服务器发送查询
-func (c *DoHClient) queryServer(serverURL string, packed []byte) (*dns.Msg, error) {
-	// 创建 HTTP POST 请求
-	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(c.config.DoH.Timeout)*time.Second)
+func (c *DoHClient) queryServer(ctx context.Context, server *DoHServerConfig, packed []byte) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout(server))
 	defer cancel()
 
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", serverURL, bytes.NewReader(packed))
+	if !strings.HasPrefix(server.URL, "https://") && !strings.HasPrefix(server.URL, "http://") {
+		transport, ok := c.transports[clientKey(server.URL, server.Proxy)]
+		if !ok {
+			return nil, fmt.Errorf("unsupported upstream URL: %s", server.URL)
+		}
+		return transport.exchange(ctx, packed)
+	}
+
+	if server.Format == formatJSON {
+		return c.queryServerJSON(ctx, server, packed)
+	}
+
+	// 创建 HTTP 请求（默认 POST，GET 按 RFC 8484 使用 base64url 编码的 dns 参数）
+	var httpReq *http.Request
+	var err error
+	switch strings.ToUpper(server.Method) {
+	case "", http.MethodPost:
+		httpReq, err = http.NewRequestWithContext(ctx, http.MethodPost, server.URL, bytes.NewReader(packed))
+		if err == nil {
+			httpReq.Header.Set("Content-Type", "application/dns-message")
+		}
+	case http.MethodGet:
+		httpReq, err = http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+		if err == nil {
+			// 按 RFC 8484 建议将消息 ID 置 0，使相同查询的 URL 一致以便 HTTP 缓存命中
+			wire := make([]byte, len(packed))
+			copy(wire, packed)
+			wire[0], wire[1] = 0, 0
+
+			query := httpReq.URL.Query()
+			query.Set("dns", base64.RawURLEncoding.EncodeToString(wire))
+			httpReq.URL.RawQuery = query.Encode()
+		}
+	default:
+		return nil, fmt.Errorf("unsupported HTTP method: %s", server.Method)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("failed to create HTTP request: %v", err)
 	}
 
 	// 设置 DoH 请求头
-	httpReq.Header.Set("Content-Type", "application/dns-message")
 	httpReq.Header.Set("Accept", "application/dns-message")
-	httpReq.Header.Set("User-Agent", "Dns2DoH/1.0")
+	c.setRequestHeaders(httpReq, server)
 
 	// 发送请求
-	httpResp, err := c.httpClient.Do(httpReq)
+	httpResp, err := c.doHTTP(server, httpReq)
 	if err != nil {
 		return nil, fmt.Errorf("failed to send DoH request: %v", err)
 	}
@@ -130,10 +554,82 @@ func (c *DoHClient) queryServer(serverURL string, packed []byte) (*dns.Msg, erro
 		return nil, fmt.Errorf("failed to parse DNS response: %v", err)
 	}
 
+	// 恢复客户端的消息 ID
+	resp.Id = binary.BigEndian.Uint16(packed)
+
+	// 按 HTTP 缓存有效期限制记录 TTL（RFC 8484 第 5.1 节）
+	if freshness, ok := httpFreshness(httpResp.Header); ok {
+		forEachRR(resp, func(rr dns.RR) {
+			rr.Header().Ttl = min(rr.Header().Ttl, freshness)
+		})
+	}
+
 	return resp, nil
 }
 
+// setRequestHeaders 设置 User-Agent 与服务器自定义请求头
+func (c *DoHClient) setRequestHeaders(httpReq *http.Request, server *DoHServerConfig) {
+	userAgent := server.UserAgent
+	if userAgent == "" {
+		userAgent = c.config.DoH.UserAgent
+	}
+	if userAgent == "" {
+		userAgent = defaultUserAgent
+	}
+	httpReq.Header.Set("User-Agent", userAgent)
+	for key, value := range server.Headers {
+		httpReq.Header.Set(key, value)
+	}
+}
+
+// httpFreshness 根据 Cache-Control 的 s-maxage/max-age 与 Age 计算响应的剩余有效期（秒）
+func httpFreshness(header http.Header) (uint32, bool) {
+	maxAge := -1
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			name, arg, _ := strings.Cut(strings.TrimSpace(directive), "=")
+			name = strings.ToLower(name)
+			if name != "max-age" && name != "s-maxage" {
+				continue
+			}
+			n, err := strconv.Atoi(strings.Trim(arg, `"`))
+			if err != nil || n < 0 {
+				continue
+			}
+			// 作为共享缓存，s-maxage 优先于 max-age
+			if name == "s-maxage" || maxAge < 0 {
+				maxAge = n
+			}
+		}
+	}
+	if maxAge < 0 {
+		return 0, false
+	}
+
+	if age, err := strconv.Atoi(header.Get("Age")); err == nil && age > 0 {
+		maxAge = max(maxAge-age, 0)
+	}
+	return uint32(maxAge), true
+}
+
+// upstreams 返回所有上游组中的全部上游
+func (c *DoHClient) upstreams() []*upstream {
+	var all []*upstream
+	for _, group := range c.groupOrder {
+		all = append(all, group.selector.upstreams...)
+	}
+	return all
+}
+
 // Close 关闭 DoH 客户端
 func (c *DoHClient) Close() {
-	c.httpClient.CloseIdleConnections()
+	if c.health != nil {
+		c.health.Stop()
+	}
+	for _, httpClient := range c.httpClients {
+		httpClient.CloseIdleConnections()
+	}
+	for _, transport := range c.transports {
+		transport.close()
+	}
 }
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+const (
+	// http3HandshakeTimeout 限制 QUIC 握手时间，使 UDP 被阻断时尽快回退到 HTTP/2。
+	// 请求的剩余时间较短时握手超时进一步缩短为剩余时间的一半，见 http3HandshakeTimeoutFor
+	http3HandshakeTimeout = 2 * time.Second
+	// http3RetryAfter 为 HTTP/3 失败后回退到 HTTP/2 的持续时间
+	http3RetryAfter = 5 * time.Minute
+)
+
+// http3State 记录各服务器的 HTTP/3 可用性
+type http3State struct {
+	mu sync.Mutex
+	// 在该时间之前不再尝试 HTTP/3
+	brokenUntil map[string]time.Time
+	// 通过 Alt-Svc 发现支持 HTTP/3 的服务器
+	discovered map[string]bool
+}
+
+// newHTTP3Client 创建 HTTP/3 客户端
+func (c *DoHClient) newHTTP3Client() *http.Client {
+	return &http.Client{
+		Transport: &http3.Transport{
+			TLSClientConfig: c.tlsManager.GetTLSConfig(),
+			QUICConfig: &quic.Config{
+				HandshakeIdleTimeout: http3HandshakeTimeout,
+			},
+			// 通过引导解析器解析主机名
+			Dial: func(ctx context.Context, addr string, tlsConfig *tls.Config, quicConfig *quic.Config) (*quic.Conn, error) {
+				addr, err := c.bootstrap.resolveAddr(ctx, addr)
+				if err != nil {
+					return nil, err
+				}
+				quicConfig = quicConfig.Clone()
+				quicConfig.HandshakeIdleTimeout = http3HandshakeTimeoutFor(ctx)
+				return quic.DialAddrEarly(ctx, addr, tlsConfig, quicConfig)
+			},
+		},
+	}
+}
+
+// http3HandshakeTimeoutFor 返回本次连接的握手超时：不超过 http3HandshakeTimeout 与请求剩余时间的一半。
+// 握手失败因此先于请求超时发生（例如 timeout 不超过 2 秒的服务器），服务器被标记为 HTTP/3 不可用，
+// 当前请求仍有时间改用 HTTP/2
+func http3HandshakeTimeoutFor(ctx context.Context) time.Duration {
+	timeout := http3HandshakeTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = min(timeout, time.Until(deadline)/2)
+	}
+	return timeout
+}
+
+// doHTTP 按服务器的 HTTP 版本发送请求。HTTP/3 连接失败时（例如 UDP/443 被阻断）
+// 当前请求改用 HTTP/2 重试，并在一段时间内不再尝试 HTTP/3
+func (c *DoHClient) doHTTP(server *DoHServerConfig, httpReq *http.Request) (*http.Response, error) {
+	version := c.selectHTTPVersion(server)
+	if version != httpVersion3 {
+		httpResp, err := c.httpClients[clientKey(version, server.Proxy)].Do(httpReq)
+		if err == nil {
+			c.checkAltSvc(server, httpResp)
+		}
+		return httpResp, err
+	}
+
+	httpResp, err := c.httpClients[httpVersion3].Do(httpReq)
+	if err == nil || httpReq.Context().Err() != nil {
+		return httpResp, err
+	}
+
+	log.Printf("[WARNING] HTTP/3 to %s failed: %v, falling back to HTTP/2 for %s", server.Name, err, http3RetryAfter)
+	c.http3.mu.Lock()
+	c.http3.brokenUntil[server.URL] = time.Now().Add(http3RetryAfter)
+	c.http3.mu.Unlock()
+
+	retry := httpReq.Clone(httpReq.Context())
+	if httpReq.GetBody != nil {
+		body, bodyErr := httpReq.GetBody()
+		if bodyErr != nil {
+			return nil, fmt.Errorf("failed to retry over HTTP/2: %v", bodyErr)
+		}
+		retry.Body = body
+	}
+	return c.httpClients[clientKey(httpVersion2, server.Proxy)].Do(retry)
+}
+
+// selectHTTPVersion 返回本次请求使用的 HTTP 版本
+func (c *DoHClient) selectHTTPVersion(server *DoHServerConfig) string {
+	wantH3 := server.HTTPVersion == httpVersion3
+
+	c.http3.mu.Lock()
+	defer c.http3.mu.Unlock()
+
+	// 仅对未显式指定 HTTP/1.1 的服务器使用 Alt-Svc 发现的结果
+	if !wantH3 && server.HTTPVersion != httpVersion11 && server.Proxy == "" && c.http3.discovered[server.URL] {
+		wantH3 = true
+	}
+	if !wantH3 {
+		return server.HTTPVersion
+	}
+
+	if time.Now().Before(c.http3.brokenUntil[server.URL]) {
+		return httpVersion2
+	}
+	return httpVersion3
+}
+
+// checkAltSvc 在启用 Alt-Svc 发现时，根据响应头记录服务器是否在同一端口提供 HTTP/3
+func (c *DoHClient) checkAltSvc(server *DoHServerConfig, httpResp *http.Response) {
+	if !c.config.DoH.AltSvc || server.HTTPVersion == httpVersion11 {
+		return
+	}
+	altSvc := httpResp.Header.Get("Alt-Svc")
+	if altSvc == "" {
+		return
+	}
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		return
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+
+	for _, entry := range strings.Split(altSvc, ",") {
+		protocol, authority, ok := strings.Cut(strings.TrimSpace(strings.SplitN(entry, ";", 2)[0]), "=")
+		if !ok || protocol != "h3" {
+			continue
+		}
+		// http3.Transport 连接原 URL 的地址，因此只接受同主机同端口的替代服务
+		if strings.Trim(authority, `"`) != ":"+port {
+			continue
+		}
+
+		c.http3.mu.Lock()
+		if !c.http3.discovered[server.URL] {
+			c.http3.discovered[server.URL] = true
+			log.Printf("DoH server %s advertises HTTP/3 via Alt-Svc, switching to HTTP/3", server.Name)
+		}
+		c.http3.mu.Unlock()
+		return
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// DoH 消息格式
+const (
+	formatWire = "wire"
+	formatJSON = "json"
+)
+
+// messageFormat 解析服务器配置的消息格式，未配置时为 RFC 8484 wire 格式
+func messageFormat(server *DoHServerConfig) string {
+	switch strings.ToLower(server.Format) {
+	case "", formatWire, "dns-message":
+		return formatWire
+	case formatJSON, "dns-json":
+		return formatJSON
+	default:
+		log.Printf("[WARNING] DoH server %s: unsupported format %q, using %s", server.Name, server.Format, formatWire)
+		return formatWire
+	}
+}
+
+// jsonResponse JSON DoH API 的响应结构（Google / Cloudflare 格式）
+type jsonResponse struct {
+	Status     int          `json:"Status"`
+	TC         bool         `json:"TC"`
+	RD         bool         `json:"RD"`
+	RA         bool         `json:"RA"`
+	AD         bool         `json:"AD"`
+	CD         bool         `json:"CD"`
+	Answer     []jsonRecord `json:"Answer"`
+	Authority  []jsonRecord `json:"Authority"`
+	Additional []jsonRecord `json:"Additional"`
+}
+
+// jsonRecord JSON 格式的资源记录
+type jsonRecord struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+// queryServerJSON 通过 JSON DoH API（application/dns-json）查询
+func (c *DoHClient) queryServerJSON(ctx context.Context, server *DoHServerConfig, packed []byte) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	if err := req.Unpack(packed); err != nil {
+		return nil, fmt.Errorf("failed to parse DNS query: %v", err)
+	}
+	if len(req.Question) == 0 {
+		return nil, fmt.Errorf("DNS query has no question")
+	}
+	q := req.Question[0]
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %v", err)
+	}
+
+	// 构造 ?name=&type=&do=&cd= 查询参数
+	query := httpReq.URL.Query()
+	query.Set("name", q.Name)
+	query.Set("type", strconv.Itoa(int(q.Qtype)))
+	opt := req.IsEdns0()
+	if opt != nil && opt.Do() {
+		query.Set("do", "1")
+	}
+	if req.CheckingDisabled {
+		query.Set("cd", "1")
+	}
+	if subnet := findECS(req); subnet != nil {
+		query.Set("edns_client_subnet", fmt.Sprintf("%s/%d", subnet.Address, subnet.SourceNetmask))
+	}
+	httpReq.URL.RawQuery = query.Encode()
+
+	httpReq.Header.Set("Accept", "application/dns-json")
+	c.setRequestHeaders(httpReq, server)
+
+	// 发送请求
+	httpResp, err := c.doHTTP(server, httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send DoH request: %v", err)
+	}
+	defer httpResp.Body.Close()
+
+	// 检查 HTTP 状态码
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH server returned error status code: %d", httpResp.StatusCode)
+	}
+
+	// 检查内容类型（Cloudflare 返回 application/dns-json，Google 返回 application/json）
+	contentType, _, _ := mime.ParseMediaType(httpResp.Header.Get("Content-Type"))
+	if contentType != "application/dns-json" && contentType != "application/json" {
+		return nil, fmt.Errorf("DoH server returned invalid content type: %s", httpResp.Header.Get("Content-Type"))
+	}
+
+	// 读取并解析 JSON 响应
+	body, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read DoH response: %v", err)
+	}
+	var jsonResp jsonResponse
+	if err := json.Unmarshal(body, &jsonResp); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON DNS response: %v", err)
+	}
+
+	resp := c.jsonToMsg(req, &jsonResp)
+
+	// 按 HTTP 缓存有效期限制记录 TTL（RFC 8484 第 5.1 节）
+	if freshness, ok := httpFreshness(httpResp.Header); ok {
+		forEachRR(resp, func(rr dns.RR) {
+			rr.Header().Ttl = min(rr.Header().Ttl, freshness)
+		})
+	}
+
+	return resp, nil
+}
+
+// jsonToMsg 将 JSON 响应转换为 DNS 消息
+func (c *DoHClient) jsonToMsg(req *dns.Msg, jsonResp *jsonResponse) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Rcode = jsonResp.Status
+	resp.Truncated = jsonResp.TC
+	resp.RecursionAvailable = jsonResp.RA
+	resp.AuthenticatedData = jsonResp.AD
+	resp.CheckingDisabled = jsonResp.CD
+
+	resp.Answer = c.jsonToRRs(jsonResp.Answer)
+	resp.Ns = c.jsonToRRs(jsonResp.Authority)
+	resp.Extra = c.jsonToRRs(jsonResp.Additional)
+
+	// 客户端使用 EDNS0 时响应也携带 OPT 记录
+	if opt := req.IsEdns0(); opt != nil {
+		resp.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+
+	return resp
+}
+
+// jsonToRRs 将 JSON 记录转换为资源记录，无法解析的记录被跳过
+func (c *DoHClient) jsonToRRs(records []jsonRecord) []dns.RR {
+	rrs := make([]dns.RR, 0, len(records))
+	for _, record := range records {
+		if record.Type == dns.TypeOPT {
+			continue
+		}
+		rrType, ok := dns.TypeToString[record.Type]
+		if !ok {
+			rrType = fmt.Sprintf("TYPE%d", record.Type)
+		}
+
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(record.Name), record.TTL, rrType, record.Data))
+		if err != nil || rr == nil {
+			if c.config.Logging.Level == "debug" {
+				log.Printf("Skipping unparsable JSON record %s %s %q: %v", record.Name, rrType, record.Data, err)
+			}
+			continue
+		}
+		rrs = append(rrs, rr)
+	}
+	return rrs
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/http2"
+)
+
+const (
+	defaultDoHPath = "/dns-query"
+	// dohIdleTimeout 入站 DoH 连接的空闲超时
+	dohIdleTimeout = 2 * time.Minute
+	// dohReadHeaderTimeout 未配置 server.timeout 时读取请求头的超时
+	dohReadHeaderTimeout = 10 * time.Second
+	dohContentType       = "application/dns-message"
+	// httpShutdownTimeout 停止时等待进行中的 HTTP 请求完成的最长时间
+	httpShutdownTimeout = 5 * time.Second
+)
+
+// startHTTPS 启动入站 DNS-over-HTTPS 监听（RFC 8484），同时支持 HTTP/1.1 与 HTTP/2
+func (s *DNSServer) startHTTPS(l *listener) error {
+	certs, err := newCertReloader(l.certFile, l.keyFile)
+	if err != nil {
+		return fmt.Errorf("DoH listener %s: %v", l.address, err)
+	}
+
+	if l.path == "" {
+		l.path = defaultDoHPath
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(l.path, func(w http.ResponseWriter, r *http.Request) {
+		s.serveDoH(l, w, r)
+	})
+
+	readHeaderTimeout := dohReadHeaderTimeout
+	if s.config.Server.Timeout > 0 {
+		readHeaderTimeout = time.Duration(s.config.Server.Timeout) * time.Second
+	}
+	server := &http.Server{
+		Addr:              l.address,
+		Handler:           mux,
+		TLSConfig:         certs.tlsConfig(),
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       dohIdleTimeout,
+	}
+	if err := http2.ConfigureServer(server, &http2.Server{}); err != nil {
+		return fmt.Errorf("failed to enable HTTP/2 for DoH server: %v", err)
+	}
+
+	ln, err := net.Listen("tcp", l.address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on https/%s: %v", l.address, err)
+	}
+	s.httpServers = append(s.httpServers, server)
+
+	go func() {
+		if err := server.ServeTLS(ln, "", ""); err != nil && err != http.ErrServerClosed {
+			log.Printf("DoH server (%s) error: %v", l.address, err)
+		}
+	}()
+	s.logListener(l)
+	return nil
+}
+
+// serveDoH 处理 RFC 8484 的 GET（?dns= base64url 编码）与 POST（application/dns-message）请求，
+// 解析后交给 handleDNSRequest，与 UDP/TCP 查询使用相同的缓存、路由与日志
+func (s *DNSServer) serveDoH(l *listener, w http.ResponseWriter, r *http.Request) {
+	var wire []byte
+	switch r.Method {
+	case http.MethodGet:
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			http.Error(w, "missing dns parameter", http.StatusBadRequest)
+			return
+		}
+		var err error
+		wire, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+		if err != nil {
+			http.Error(w, "invalid dns parameter", http.StatusBadRequest)
+			return
+		}
+
+	case http.MethodPost:
+		contentType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if contentType != dohContentType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		var err error
+		wire, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize+1))
+		if err != nil {
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+		if len(wire) > dns.MaxMsgSize {
+			http.Error(w, "DNS message too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(wire); err != nil {
+		if s.config.Logging.Level == "debug" {
+			log.Printf("Invalid DoH query from %s: %v", r.RemoteAddr, err)
+		}
+		http.Error(w, "invalid DNS message", http.StatusBadRequest)
+		return
+	}
+
+	writer := newDoHResponseWriter(w, r, req)
+	s.handleDNSRequest(l, writer, req)
+	if !writer.written {
+		if writer.status != 0 {
+			http.Error(w, http.StatusText(writer.status), writer.status)
+			return
+		}
+		// 未写入响应（如访问控制设置为 drop）时直接断开连接，不返回任何 HTTP 响应
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// dohResponseWriter 将 DNS 响应写入 HTTP 响应的 dns.ResponseWriter
+type dohResponseWriter struct {
+	w       http.ResponseWriter
+	req     *dns.Msg
+	local   net.Addr
+	remote  net.Addr
+	written bool
+	// 未写入 DNS 响应时返回的 HTTP 状态码，0 表示断开连接
+	status int
+}
+
+// newDoHResponseWriter 创建 HTTP 请求对应的 dns.ResponseWriter，客户端地址取自连接的对端地址
+func newDoHResponseWriter(w http.ResponseWriter, r *http.Request, req *dns.Msg) *dohResponseWriter {
+	writer := &dohResponseWriter{w: w, req: req}
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		writer.local = addr
+	}
+	if addrPort, err := netip.ParseAddrPort(r.RemoteAddr); err == nil {
+		writer.remote = net.TCPAddrFromAddrPort(addrPort)
+	} else {
+		writer.remote = &net.TCPAddr{}
+	}
+	return writer
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr  { return w.local }
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return w.remote }
+
+// WriteMsg 打包并写入响应。客户端查询带有填充时按 RFC 8467 将响应填充为 468 字节的整数倍，
+// Cache-Control 按响应中记录的最小 TTL 设置（RFC 8484 第 5.1 节）
+func (w *dohResponseWriter) WriteMsg(msg *dns.Msg) error {
+	if opt := w.req.IsEdns0(); opt != nil && hasEDNS0Option(opt, dns.EDNS0PADDING) {
+		padMessage(msg, responsePaddingBlockSize)
+	}
+	packed, err := msg.Pack()
+	if err != nil {
+		return err
+	}
+
+	var minTTL uint32
+	found := false
+	forEachRR(msg, func(rr dns.RR) {
+		if !found || rr.Header().Ttl < minTTL {
+			minTTL = rr.Header().Ttl
+			found = true
+		}
+	})
+	if found {
+		w.w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(minTTL), 10))
+	}
+	_, err = w.Write(packed)
+	return err
+}
+
+// Write 写入已打包的 DNS 消息
+func (w *dohResponseWriter) Write(b []byte) (int, error) {
+	w.written = true
+	w.w.Header().Set("Content-Type", dohContentType)
+	w.w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	return w.w.Write(b)
+}
+
+// reject 不返回 DNS 响应，改为返回 HTTP 状态码 status（如限速时的 429）
+func (w *dohResponseWriter) reject(status int) {
+	w.status = status
+}
+
+func (w *dohResponseWriter) Close() error        { return nil }
+func (w *dohResponseWriter) TsigStatus() error   { return nil }
+func (w *dohResponseWriter) TsigTimersOnly(bool) {}
+func (w *dohResponseWriter) Hijack()             {}
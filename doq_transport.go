@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	schemeDoQ      = "quic://"
+	defaultDoQPort = "853"
+	// doqALPN 为 RFC 9250 规定的 ALPN 标识
+	doqALPN = "doq"
+	// doqNoError 为正常关闭连接时使用的 DOQ_NO_ERROR 错误码
+	doqNoError = 0x0
+	// defaultDoQIdleTimeout 为 QUIC 连接的最大空闲时间
+	defaultDoQIdleTimeout = 30 * time.Second
+)
+
+// doqTransport DNS-over-QUIC（RFC 9250）上游传输，每个上游复用一个 QUIC 连接，每个查询使用独立的流
+type doqTransport struct {
+	addr       string
+	tlsConfig  *tls.Config
+	quicConfig *quic.Config
+	bootstrap  *bootstrapResolver
+
+	mu   sync.Mutex
+	conn *quic.Conn
+}
+
+// newDoQTransport 根据 quic://host[:port] 地址创建 DoQ 传输
+func newDoQTransport(serverURL string, tlsConfig *tls.Config, bootstrap *bootstrapResolver) (*doqTransport, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DoQ server URL: %v", err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid DoQ server URL: missing host")
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultDoQPort
+	}
+
+	tlsConfig = tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = u.Hostname()
+	}
+	tlsConfig.NextProtos = []string{doqALPN}
+	tlsConfig.MinVersion = tls.VersionTLS13
+	// 会话缓存用于会话恢复，服务器允许时可发送 0-RTT 数据
+	tlsConfig.ClientSessionCache = tls.NewLRUClientSessionCache(0)
+
+	return &doqTransport{
+		addr:      net.JoinHostPort(u.Hostname(), port),
+		tlsConfig: tlsConfig,
+		quicConfig: &quic.Config{
+			MaxIdleTimeout: defaultDoQIdleTimeout,
+		},
+		bootstrap: bootstrap,
+	}, nil
+}
+
+// exchange 在新的流上发送查询并读取响应。复用的连接失效时在新连接上重试一次
+func (t *doqTransport) exchange(ctx context.Context, packed []byte) (*dns.Msg, error) {
+	if len(packed) < 2 {
+		return nil, fmt.Errorf("invalid DNS query")
+	}
+	id := binary.BigEndian.Uint16(packed)
+
+	// RFC 9250 要求消息 ID 为 0，消息前带两字节长度
+	frame := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(frame, uint16(len(packed)))
+	copy(frame[2:], packed)
+	frame[2], frame[3] = 0, 0
+
+	for attempt := 0; ; attempt++ {
+		conn, reused, err := t.getConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := t.exchangeStream(ctx, conn, frame)
+		if err != nil {
+			// 连接已失效（如空闲超时）时丢弃并重试一次
+			if conn.Context().Err() != nil {
+				t.dropConn(conn)
+				if reused && attempt == 0 && ctx.Err() == nil {
+					continue
+				}
+			}
+			return nil, err
+		}
+
+		resp.Id = id
+		return resp, nil
+	}
+}
+
+// exchangeStream 在单个双向流上完成一次查询
+func (t *doqTransport) exchangeStream(ctx context.Context, conn *quic.Conn, frame []byte) (*dns.Msg, error) {
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open DoQ stream: %v", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		stream.SetDeadline(deadline)
+	}
+
+	if _, err := stream.Write(frame); err != nil {
+		stream.CancelRead(doqNoError)
+		return nil, fmt.Errorf("failed to send DoQ query: %v", err)
+	}
+	// 发送完毕后关闭写方向，表示查询结束
+	stream.Close()
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(stream, header); err != nil {
+		stream.CancelRead(doqNoError)
+		return nil, fmt.Errorf("failed to read DoQ response: %v", err)
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		stream.CancelRead(doqNoError)
+		return nil, fmt.Errorf("failed to read DoQ response: %v", err)
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(buf); err != nil {
+		return nil, fmt.Errorf("failed to parse DNS response: %v", err)
+	}
+	return resp, nil
+}
+
+// getConn 返回可用的 QUIC 连接，必要时使用 0-RTT（如果可用）重新建立
+func (t *doqTransport) getConn(ctx context.Context) (*quic.Conn, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn != nil && t.conn.Context().Err() == nil {
+		return t.conn, true, nil
+	}
+
+	addr, err := t.bootstrap.resolveAddr(ctx, t.addr)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to resolve DoQ server %s: %v", t.addr, err)
+	}
+	conn, err := quic.DialAddrEarly(ctx, addr, t.tlsConfig, t.quicConfig)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to connect to DoQ server %s: %v", t.addr, err)
+	}
+	t.conn = conn
+	return conn, false, nil
+}
+
+// dropConn 丢弃已失效的连接
+func (t *doqTransport) dropConn(conn *quic.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn == conn {
+		t.conn = nil
+	}
+}
+
+// close 关闭当前连接
+func (t *doqTransport) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != nil {
+		t.conn.CloseWithError(doqNoError, "")
+		t.conn = nil
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// doqStandIn 本地 DoQ 服务器，记录收到的连接数、流数与查询消息 ID
+type doqStandIn struct {
+	listener *quic.Listener
+	certPool *x509.CertPool
+
+	mu      sync.Mutex
+	conns   int
+	streams int
+	ids     []uint16
+}
+
+// newDoQStandIn 使用自签名证书在 127.0.0.1 上启动 ALPN 为 doq 的 QUIC 服务器
+func newDoQStandIn(t *testing.T, idleTimeout time.Duration) *doqStandIn {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &doqStandIn{certPool: x509.NewCertPool()}
+	s.certPool.AddCert(cert)
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{doqALPN},
+	}
+	// 配置无状态重置密钥，使服务器对已丢弃连接的数据包回复无状态重置（RFC 9000 第 10.3 节）
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resetKey quic.StatelessResetKey
+	rand.Read(resetKey[:])
+	transport := &quic.Transport{Conn: udpConn, StatelessResetKey: &resetKey}
+	s.listener, err = transport.Listen(tlsConfig, &quic.Config{MaxIdleTimeout: idleTimeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.listener.Close()
+		transport.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := s.listener.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+			go s.serveConn(conn)
+		}
+	}()
+	return s
+}
+
+// serveConn 每个流读取一个查询并返回一条 A 记录，响应的消息 ID 与查询相同（RFC 9250 要求为 0）
+func (s *doqStandIn) serveConn(conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.streams++
+		s.mu.Unlock()
+
+		go func() {
+			defer stream.Close()
+			header := make([]byte, 2)
+			if _, err := io.ReadFull(stream, header); err != nil {
+				return
+			}
+			buf := make([]byte, binary.BigEndian.Uint16(header))
+			if _, err := io.ReadFull(stream, buf); err != nil {
+				return
+			}
+			req := new(dns.Msg)
+			if err := req.Unpack(buf); err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.ids = append(s.ids, req.Id)
+			s.mu.Unlock()
+
+			resp := new(dns.Msg)
+			resp.SetReply(req)
+			rr, _ := dns.NewRR(req.Question[0].Name + " 60 IN A 192.0.2.1")
+			resp.Answer = append(resp.Answer, rr)
+			packed, err := resp.Pack()
+			if err != nil {
+				return
+			}
+			frame := make([]byte, 2+len(packed))
+			binary.BigEndian.PutUint16(frame, uint16(len(packed)))
+			copy(frame[2:], packed)
+			stream.Write(frame)
+		}()
+	}
+}
+
+// counts 返回连接数、流数与收到的查询消息 ID
+func (s *doqStandIn) counts() (int, int, []uint16) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns, s.streams, append([]uint16(nil), s.ids...)
+}
+
+// newTestDoQTransport 创建连接到 stand-in 的 DoQ 传输
+func newTestDoQTransport(t *testing.T, s *doqStandIn) *doqTransport {
+	t.Helper()
+	transport, err := newDoQTransport("quic://"+s.listener.Addr().String(), &tls.Config{RootCAs: s.certPool}, newBootstrapResolver(&Config{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(transport.close)
+	return transport
+}
+
+// exchangeTestQuery 发送消息 ID 为 id 的 A 查询并检查响应
+func exchangeTestQuery(t *testing.T, transport *doqTransport, id uint16) {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion("example.test.", dns.TypeA)
+	req.Id = id
+	packed, err := req.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	resp, err := transport.exchange(ctx, packed)
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if resp.Id != id {
+		t.Errorf("response ID = %#x, want %#x", resp.Id, id)
+	}
+	if len(resp.Answer) != 1 {
+		t.Errorf("got %d answers, want 1", len(resp.Answer))
+	}
+}
+
+func TestDoQTransportMessageID(t *testing.T) {
+	s := newDoQStandIn(t, 0)
+	transport := newTestDoQTransport(t, s)
+
+	exchangeTestQuery(t, transport, 0x1234)
+
+	if _, _, ids := s.counts(); len(ids) != 1 || ids[0] != 0 {
+		t.Errorf("message IDs on the wire = %v, want [0]", ids)
+	}
+}
+
+func TestDoQTransportStreamPerQuery(t *testing.T) {
+	s := newDoQStandIn(t, 0)
+	transport := newTestDoQTransport(t, s)
+
+	for i := 1; i <= 3; i++ {
+		exchangeTestQuery(t, transport, uint16(i))
+	}
+
+	if conns, streams, _ := s.counts(); conns != 1 || streams != 3 {
+		t.Errorf("got %d connections and %d streams, want 1 connection and 3 streams", conns, streams)
+	}
+}
+
+func TestDoQTransportIdleClose(t *testing.T) {
+	// stand-in 在 200ms 空闲后静默丢弃连接，而客户端接受的对端空闲超时至少为 5 秒，
+	// 第二个查询因此使用已失效的复用连接，收到无状态重置后应在新连接上重试
+	s := newDoQStandIn(t, 200*time.Millisecond)
+	transport := newTestDoQTransport(t, s)
+
+	exchangeTestQuery(t, transport, 1)
+	conn := transport.conn
+	time.Sleep(500 * time.Millisecond)
+	if conn.Context().Err() != nil {
+		t.Fatal("client noticed the idle close before reusing the connection")
+	}
+
+	exchangeTestQuery(t, transport, 2)
+
+	if conns, streams, _ := s.counts(); conns != 2 || streams != 2 {
+		t.Errorf("got %d connections and %d streams, want 2 connections and 2 streams", conns, streams)
+	}
+	if transport.conn == conn {
+		t.Error("dead connection was reused")
+	}
+}
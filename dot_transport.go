@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	schemeDoT      = "tls://"
+	defaultDoTPort = "853"
+	// defaultDoTIdleTimeout 为服务器未通告 edns-tcp-keepalive 时的空闲连接保持时间
+	defaultDoTIdleTimeout = 10 * time.Second
+	// maxDoTIdleTimeout 限制服务器通告的空闲保持时间
+	maxDoTIdleTimeout = 2 * time.Minute
+)
+
+var errDoTConnClosed = errors.New("DoT connection closed")
+
+// dialFunc 建立到上游的网络连接
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// dotTransport DNS-over-TLS（RFC 7858）上游传输，复用单个连接并支持流水线查询
+type dotTransport struct {
+	addr      string
+	tlsConfig *tls.Config
+	dial      dialFunc
+
+	mu   sync.Mutex
+	conn *dotConn
+}
+
+// newDoTTransport 根据 tls://host[:port] 地址创建 DoT 传输
+func newDoTTransport(serverURL string, tlsConfig *tls.Config, dial dialFunc) (*dotTransport, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DoT server URL: %v", err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid DoT server URL: missing host")
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultDoTPort
+	}
+
+	tlsConfig = tlsConfig.Clone()
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = u.Hostname()
+	}
+
+	if dial == nil {
+		dialer := &net.Dialer{}
+		dial = dialer.DialContext
+	}
+
+	return &dotTransport{
+		addr:      net.JoinHostPort(u.Hostname(), port),
+		tlsConfig: tlsConfig,
+		dial:      dial,
+	}, nil
+}
+
+// exchange 发送查询并等待响应。复用的连接若已被服务器关闭，则在新连接上重试一次
+func (t *dotTransport) exchange(ctx context.Context, packed []byte) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	if err := req.Unpack(packed); err != nil {
+		return nil, fmt.Errorf("failed to parse DNS query: %v", err)
+	}
+	id := req.Id
+
+	// 请求 edns-tcp-keepalive（RFC 7828），仅在查询已携带 OPT 时添加。
+	// 已填充的查询从填充中扣除该选项的 4 字节，保持填充后的长度不变，填充不足时不添加
+	if opt := req.IsEdns0(); opt != nil && !hasEDNS0Option(opt, dns.EDNS0TCPKEEPALIVE) && shrinkPadding(opt, 4) {
+		opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+	}
+
+	for attempt := 0; ; attempt++ {
+		conn, reused, err := t.getConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := conn.exchange(ctx, req)
+		if err != nil {
+			if reused && attempt == 0 && errors.Is(err, errDoTConnClosed) && ctx.Err() == nil {
+				continue
+			}
+			return nil, err
+		}
+
+		resp.Id = id
+		// TCP keepalive 选项仅对本连接有效，不转发给客户端
+		if opt := resp.IsEdns0(); opt != nil {
+			removeEDNS0Option(opt, dns.EDNS0TCPKEEPALIVE)
+		}
+		return resp, nil
+	}
+}
+
+// getConn 返回可用的连接，必要时重新建立
+func (t *dotTransport) getConn(ctx context.Context) (*dotConn, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn != nil && !t.conn.isClosed() {
+		return t.conn, true, nil
+	}
+
+	rawConn, err := t.dial(ctx, "tcp", t.addr)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to connect to DoT server %s: %v", t.addr, err)
+	}
+
+	tlsConn := tls.Client(rawConn, t.tlsConfig)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		rawConn.Close()
+		return nil, false, fmt.Errorf("TLS handshake with DoT server %s failed: %v", t.addr, err)
+	}
+
+	t.conn = newDoTConn(tlsConn)
+	return t.conn, false, nil
+}
+
+// close 关闭当前连接
+func (t *dotTransport) close() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.conn != nil {
+		t.conn.close(errDoTConnClosed)
+		t.conn = nil
+	}
+}
+
+// dotConn 单个 DoT 连接，查询按消息 ID 匹配响应，允许乱序返回
+type dotConn struct {
+	conn    net.Conn
+	writeMu sync.Mutex
+
+	mu          sync.Mutex
+	pending     map[uint16]chan *dns.Msg
+	nextID      uint16
+	closed      bool
+	err         error
+	idleTimeout time.Duration
+	idleTimer   *time.Timer
+}
+
+// newDoTConn 创建连接并启动读取循环
+func newDoTConn(conn net.Conn) *dotConn {
+	c := &dotConn{
+		conn:        conn,
+		pending:     make(map[uint16]chan *dns.Msg),
+		nextID:      dns.Id(),
+		idleTimeout: defaultDoTIdleTimeout,
+	}
+	go c.readLoop()
+	return c
+}
+
+// exchange 在连接上发送查询。为避免不同客户端的消息 ID 冲突，使用连接内唯一的 ID
+func (c *dotConn) exchange(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	ch := make(chan *dns.Msg, 1)
+
+	c.mu.Lock()
+	if c.closed {
+		err := c.err
+		c.mu.Unlock()
+		return nil, err
+	}
+	if len(c.pending) >= 0xFFFF {
+		c.mu.Unlock()
+		return nil, fmt.Errorf("too many pending DoT queries")
+	}
+	for {
+		c.nextID++
+		if _, used := c.pending[c.nextID]; !used {
+			break
+		}
+	}
+	id := c.nextID
+	c.pending[id] = ch
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+	c.mu.Unlock()
+
+	msg := req.Copy()
+	msg.Id = id
+	packed, err := msg.Pack()
+	if err != nil {
+		c.release(id)
+		return nil, fmt.Errorf("failed to pack DNS message: %v", err)
+	}
+
+	// 写入带两字节长度前缀的消息
+	frame := make([]byte, 2+len(packed))
+	binary.BigEndian.PutUint16(frame, uint16(len(packed)))
+	copy(frame[2:], packed)
+
+	c.writeMu.Lock()
+	if deadline, ok := ctx.Deadline(); ok {
+		c.conn.SetWriteDeadline(deadline)
+	}
+	_, err = c.conn.Write(frame)
+	c.writeMu.Unlock()
+	if err != nil {
+		c.close(errDoTConnClosed)
+		return nil, fmt.Errorf("failed to send DoT query: %w", errDoTConnClosed)
+	}
+
+	select {
+	case resp, ok := <-ch:
+		if !ok {
+			return nil, c.err
+		}
+		return resp, nil
+	case <-ctx.Done():
+		c.release(id)
+		return nil, fmt.Errorf("DoT query timed out: %v", ctx.Err())
+	}
+}
+
+// release 移除未完成的查询
+func (c *dotConn) release(id uint16) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.pending, id)
+	c.scheduleIdleClose()
+}
+
+// readLoop 读取响应并分发给等待中的查询
+func (c *dotConn) readLoop() {
+	header := make([]byte, 2)
+	for {
+		if _, err := io.ReadFull(c.conn, header); err != nil {
+			c.close(errDoTConnClosed)
+			return
+		}
+		buf := make([]byte, binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(c.conn, buf); err != nil {
+			c.close(errDoTConnClosed)
+			return
+		}
+
+		resp := new(dns.Msg)
+		if err := resp.Unpack(buf); err != nil {
+			continue
+		}
+
+		c.mu.Lock()
+		ch, ok := c.pending[resp.Id]
+		if ok {
+			delete(c.pending, resp.Id)
+			c.updateIdleTimeout(resp)
+			c.scheduleIdleClose()
+		}
+		c.mu.Unlock()
+
+		if ok {
+			ch <- resp
+		}
+	}
+}
+
+// updateIdleTimeout 根据服务器通告的 edns-tcp-keepalive 超时调整空闲保持时间，调用方需持有锁
+func (c *dotConn) updateIdleTimeout(resp *dns.Msg) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return
+	}
+	for _, o := range opt.Option {
+		if keepalive, ok := o.(*dns.EDNS0_TCP_KEEPALIVE); ok {
+			// 超时单位为 100 毫秒
+			c.idleTimeout = min(time.Duration(keepalive.Timeout)*100*time.Millisecond, maxDoTIdleTimeout)
+		}
+	}
+}
+
+// scheduleIdleClose 在没有未完成查询时启动空闲关闭计时器，调用方需持有锁
+func (c *dotConn) scheduleIdleClose() {
+	if c.closed || len(c.pending) > 0 {
+		return
+	}
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+	c.idleTimer = time.AfterFunc(c.idleTimeout, func() {
+		c.mu.Lock()
+		idle := len(c.pending) == 0
+		c.mu.Unlock()
+		if idle {
+			c.close(errDoTConnClosed)
+		}
+	})
+}
+
+// isClosed 判断连接是否已关闭
+func (c *dotConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// close 关闭连接并使所有等待中的查询失败
+func (c *dotConn) close(err error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return
+	}
+	c.closed = true
+	c.err = err
+	pending := c.pending
+	c.pending = make(map[uint16]chan *dns.Msg)
+	if c.idleTimer != nil {
+		c.idleTimer.Stop()
+	}
+	c.mu.Unlock()
+
+	c.conn.Close()
+	for _, ch := range pending {
+		close(ch)
+	}
+}
+
+// hasEDNS0Option 判断 OPT 记录是否包含指定选项
+func hasEDNS0Option(opt *dns.OPT, code uint16) bool {
+	for _, o := range opt.Option {
+		if o.Option() == code {
+			return true
+		}
+	}
+	return false
+}
+
+// removeEDNS0Option 从 OPT 记录中移除指定选项
+func removeEDNS0Option(opt *dns.OPT, code uint16) {
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != code {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// ECS 策略模式
+const (
+	ecsPassthrough = "passthrough"
+	ecsStrip       = "strip"
+	ecsSynthesize  = "synthesize"
+)
+
+const (
+	defaultECSIPv4Prefix = 24
+	defaultECSIPv6Prefix = 56
+	// edns0UDPSize 为未使用 EDNS0 的查询添加 OPT 记录（ECS、填充）时声明的缓冲区大小
+	edns0UDPSize = 1232
+)
+
+// ecsPolicy EDNS Client Subnet（RFC 7871）策略，决定发往上游的查询携带的 ECS 选项
+type ecsPolicy struct {
+	mode       string
+	ipv4Prefix uint8
+	ipv6Prefix uint8
+	// synthesize 模式下使用的固定子网，为 nil 时按客户端地址生成
+	subnet *dns.EDNS0_SUBNET
+}
+
+// ecsClient 查询客户端的地址及其发送的 ECS 选项
+type ecsClient struct {
+	ip     net.IP
+	subnet *dns.EDNS0_SUBNET
+}
+
+// newECSClient 从客户端地址与原始查询创建 ecsClient
+func newECSClient(addr net.Addr, req *dns.Msg) ecsClient {
+	var client ecsClient
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		client.ip = addr.IP
+	case *net.TCPAddr:
+		client.ip = addr.IP
+	}
+	client.subnet = findECS(req)
+	return client
+}
+
+// newECSPolicy 根据配置创建 ECS 策略，未配置模式时为 passthrough
+func newECSPolicy(cfg ECSConfig) (*ecsPolicy, error) {
+	p := &ecsPolicy{
+		mode:       cfg.Mode,
+		ipv4Prefix: defaultECSIPv4Prefix,
+		ipv6Prefix: defaultECSIPv6Prefix,
+	}
+	switch p.mode {
+	case "":
+		p.mode = ecsPassthrough
+	case ecsPassthrough, ecsStrip, ecsSynthesize:
+	default:
+		return nil, fmt.Errorf("unknown ECS mode %q (use passthrough, strip or synthesize)", cfg.Mode)
+	}
+
+	if cfg.IPv4Prefix < 0 || cfg.IPv4Prefix > 32 {
+		return nil, fmt.Errorf("invalid ECS ipv4_prefix %d", cfg.IPv4Prefix)
+	}
+	if cfg.IPv6Prefix < 0 || cfg.IPv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid ECS ipv6_prefix %d", cfg.IPv6Prefix)
+	}
+	if cfg.IPv4Prefix > 0 {
+		p.ipv4Prefix = uint8(cfg.IPv4Prefix)
+	}
+	if cfg.IPv6Prefix > 0 {
+		p.ipv6Prefix = uint8(cfg.IPv6Prefix)
+	}
+
+	if cfg.Subnet != "" {
+		_, subnet, err := net.ParseCIDR(cfg.Subnet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ECS subnet: %v", err)
+		}
+		ones, _ := subnet.Mask.Size()
+		p.subnet = newECSOption(subnet.IP, uint8(ones))
+	}
+
+	return p, nil
+}
+
+// String 返回策略的描述，用于日志输出
+func (p *ecsPolicy) String() string {
+	switch {
+	case p.mode != ecsSynthesize:
+		return p.mode
+	case p.subnet != nil:
+		return fmt.Sprintf("%s (%s/%d)", p.mode, p.subnet.Address, p.subnet.SourceNetmask)
+	default:
+		return fmt.Sprintf("%s (/%d, /%d)", p.mode, p.ipv4Prefix, p.ipv6Prefix)
+	}
+}
+
+// option 返回发往上游的 ECS 选项，nil 表示不携带 ECS
+func (p *ecsPolicy) option(client ecsClient) *dns.EDNS0_SUBNET {
+	switch p.mode {
+	case ecsStrip:
+		return nil
+	case ecsSynthesize:
+		if p.subnet != nil {
+			return p.subnet
+		}
+		// 私有、环回等地址对上游没有地理意义，且会泄露内部网络结构
+		ip := client.ip
+		if ip == nil || ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+			return nil
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return newECSOption(ip4, p.ipv4Prefix)
+		}
+		return newECSOption(ip, p.ipv6Prefix)
+	default:
+		return client.subnet
+	}
+}
+
+// apply 返回按策略设置 ECS 选项后的查询。ECS 无需改变时直接返回 req，否则返回修改后的副本
+func (p *ecsPolicy) apply(req *dns.Msg, client ecsClient) *dns.Msg {
+	option := p.option(client)
+	if equalECS(findECS(req), option) {
+		return req
+	}
+
+	msg := req.Copy()
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(edns0UDPSize, false)
+		opt = msg.IsEdns0()
+	}
+	removeEDNS0Option(opt, dns.EDNS0SUBNET)
+	if option != nil {
+		opt.Option = append(opt.Option, option)
+	}
+	return msg
+}
+
+// newECSOption 创建掩码后的 ECS 选项
+func newECSOption(ip net.IP, prefix uint8) *dns.EDNS0_SUBNET {
+	option := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, SourceNetmask: prefix}
+	if ip4 := ip.To4(); ip4 != nil {
+		option.Family = 1
+		option.Address = ip4.Mask(net.CIDRMask(int(prefix), 32))
+	} else {
+		option.Family = 2
+		option.Address = ip.Mask(net.CIDRMask(int(prefix), 128))
+	}
+	return option
+}
+
+// findECS 返回消息中的 ECS 选项
+func findECS(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+	for _, o := range opt.Option {
+		if subnet, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+	return nil
+}
+
+// equalECS 判断两个 ECS 选项的子网是否相同
+func equalECS(a, b *dns.EDNS0_SUBNET) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Family == b.Family && a.SourceNetmask == b.SourceNetmask && a.Address.Equal(b.Address)
+}
+
+// ecsKey 返回查询 ECS 子网的缓存键后缀，不携带 ECS 时为空
+func ecsKey(req *dns.Msg) string {
+	subnet := findECS(req)
+	if subnet == nil {
+		return ""
+	}
+	return fmt.Sprintf("|%s/%d", subnet.Address, subnet.SourceNetmask)
+}
+
+// restoreClientEDNS 使响应的 EDNS0 内容与客户端的原始查询一致：客户端未使用 EDNS0 时去掉 OPT 记录，
+// 未发送 ECS 时去掉 ECS 选项，ECS 被策略替换时按 RFC 7871 回显客户端的子网
+func restoreClientEDNS(resp *dns.Msg, req *dns.Msg) {
+	if req.IsEdns0() == nil {
+		extra := resp.Extra[:0]
+		for _, rr := range resp.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+		resp.Extra = extra
+		return
+	}
+
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return
+	}
+	subnet := findECS(req)
+	if subnet == nil {
+		removeEDNS0Option(opt, dns.EDNS0SUBNET)
+		return
+	}
+	if replied := findECS(resp); replied != nil && !equalECS(replied, subnet) {
+		// 上游的作用域对应的是替换后的子网，对客户端的子网不适用
+		removeEDNS0Option(opt, dns.EDNS0SUBNET)
+		opt.Option = append(opt.Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        subnet.Family,
+			SourceNetmask: subnet.SourceNetmask,
+			Address:       subnet.Address,
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// circuitState 上游服务器的熔断状态
+type circuitState int
+
+const (
+	// circuitClosed 正常状态，服务器参与查询
+	circuitClosed circuitState = iota
+	// circuitOpen 连续失败达到阈值，服务器被跳过
+	circuitOpen
+	// circuitHalfOpen 熔断冷却结束，允许一次试探查询
+	circuitHalfOpen
+)
+
+const (
+	defaultFailureThreshold    = 3
+	defaultRecoveryTimeout     = 30
+	defaultHealthCheckInterval = 30
+	defaultHealthCheckName     = "."
+	defaultHealthCheckType     = "NS"
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// breakerSettings 熔断参数，threshold 为 0 表示不启用熔断
+type breakerSettings struct {
+	threshold int
+	cooldown  time.Duration
+}
+
+// newBreakerSettings 根据配置生成熔断参数
+func newBreakerSettings(config *Config) breakerSettings {
+	hc := config.DoH.HealthCheck
+	threshold := hc.FailureThreshold
+	if threshold == 0 {
+		threshold = defaultFailureThreshold
+	} else if threshold < 0 {
+		threshold = 0
+	}
+	cooldown := hc.RecoveryTimeout
+	if cooldown <= 0 {
+		cooldown = defaultRecoveryTimeout
+	}
+	return breakerSettings{
+		threshold: threshold,
+		cooldown:  time.Duration(cooldown) * time.Second,
+	}
+}
+
+// available 判断服务器当前是否可以参与查询。
+// 熔断冷却结束后转为半开状态，每个冷却周期只放行一次试探查询
+func (u *upstream) available() bool {
+	if u.breaker.threshold == 0 {
+		return true
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	now := time.Now()
+	switch u.state {
+	case circuitOpen:
+		if now.Sub(u.openedAt) < u.breaker.cooldown {
+			return false
+		}
+		u.setState(circuitHalfOpen)
+		u.trialAt = now
+		return true
+	case circuitHalfOpen:
+		// 上一次试探查询可能未被实际发出，超过冷却时间后再次放行
+		if now.Sub(u.trialAt) < u.breaker.cooldown {
+			return false
+		}
+		u.trialAt = now
+		return true
+	default:
+		return true
+	}
+}
+
+// recordSuccess 记录一次成功查询，关闭熔断
+func (u *upstream) recordSuccess(rtt time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.updateRTT(rtt)
+	u.failures = 0
+	if u.state != circuitClosed {
+		u.setState(circuitClosed)
+	}
+}
+
+// recordFailure 记录一次失败查询，按超时时间计入 RTT 使 fastest 策略降低其优先级，
+// 连续失败达到阈值或半开试探失败时打开熔断
+func (u *upstream) recordFailure(timeout time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.updateRTT(timeout)
+	u.failures++
+	if u.breaker.threshold == 0 {
+		return
+	}
+	switch {
+	case u.state == circuitOpen:
+		// 熔断期间探测仍失败，重新计算冷却时间
+		u.openedAt = time.Now()
+	case u.state == circuitHalfOpen || u.failures >= u.breaker.threshold:
+		u.openedAt = time.Now()
+		u.setState(circuitOpen)
+	}
+}
+
+// setState 切换熔断状态并记录日志，调用方需持有锁
+func (u *upstream) setState(state circuitState) {
+	log.Printf("[Health] DoH server %s: circuit %s -> %s (consecutive failures: %d)",
+		u.config.Name, u.state, state, u.failures)
+	u.state = state
+}
+
+// healthStatus 返回服务器健康状态摘要
+func (u *upstream) healthStatus() (circuitState, int, time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.state, u.failures, u.rtt
+}
+
+// healthChecker 定期向所有上游发送探测查询
+type healthChecker struct {
+	client   *DoHClient
+	interval time.Duration
+	probe    *dns.Msg
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// newHealthChecker 根据配置创建健康检查器
+func newHealthChecker(client *DoHClient) *healthChecker {
+	hc := client.config.DoH.HealthCheck
+
+	interval := hc.Interval
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+	name := hc.Name
+	if name == "" {
+		name = defaultHealthCheckName
+	}
+	qtype, ok := dns.StringToType[strings.ToUpper(hc.Type)]
+	if !ok {
+		if hc.Type != "" {
+			log.Printf("[WARNING] Unknown health check query type %q, using %s", hc.Type, defaultHealthCheckType)
+		}
+		qtype = dns.StringToType[defaultHealthCheckType]
+	}
+
+	probe := new(dns.Msg)
+	probe.SetQuestion(dns.Fqdn(name), qtype)
+	probe.RecursionDesired = true
+
+	return &healthChecker{
+		client:   client,
+		interval: time.Duration(interval) * time.Second,
+		probe:    probe,
+		stop:     make(chan struct{}),
+	}
+}
+
+// Start 启动后台健康检查
+func (h *healthChecker) Start() {
+	log.Printf("[Health] Probing %d upstream servers every %s (%s %s)", len(h.client.upstreams()),
+		h.interval, h.probe.Question[0].Name, dns.TypeToString[h.probe.Question[0].Qtype])
+
+	h.wg.Add(1)
+	go func() {
+		defer h.wg.Done()
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				h.probeAll()
+			case <-h.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop 停止健康检查
+func (h *healthChecker) Stop() {
+	close(h.stop)
+	h.wg.Wait()
+}
+
+// probeAll 并发探测所有上游服务器
+func (h *healthChecker) probeAll() {
+	var wg sync.WaitGroup
+	upstreams := h.client.upstreams()
+	for _, u := range upstreams {
+		wg.Add(1)
+		go func(u *upstream) {
+			defer wg.Done()
+			h.probeUpstream(u)
+		}(u)
+	}
+	wg.Wait()
+
+	if h.client.config.Logging.Level == "debug" {
+		for _, u := range upstreams {
+			state, failures, rtt := u.healthStatus()
+			log.Printf("[Health] %s: %s (failures: %d, avg rtt: %s)", u.config.Name, state, failures, rtt.Round(time.Millisecond))
+		}
+	}
+}
+
+// probeUpstream 向单个服务器发送探测查询，SERVFAIL 与 REFUSED 视为失败
+func (h *healthChecker) probeUpstream(u *upstream) {
+	probe := h.probe.Copy()
+	probe.Id = dns.Id()
+	packed, err := probe.Pack()
+	if err != nil {
+		return
+	}
+
+	start := time.Now()
+	resp, err := h.client.queryServer(context.Background(), &u.config, packed)
+	if err == nil && (resp.Rcode == dns.RcodeServerFailure || resp.Rcode == dns.RcodeRefused) {
+		err = fmt.Errorf("probe returned %s", dns.RcodeToString[resp.Rcode])
+	}
+	if err != nil {
+		if h.client.config.Logging.Level == "debug" {
+			log.Printf("[Health] Probe to %s failed: %v", u.config.Name, err)
+		}
+		u.recordFailure(h.client.timeout(&u.config))
+		return
+	}
+	u.recordSuccess(time.Since(start))
+}
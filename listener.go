@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// 监听协议
+const (
+	protocolUDP   = "udp"
+	protocolTCP   = "tcp"
+	protocolTLS   = "tls"
+	protocolHTTPS = "https"
+)
+
+// listener 监听地址及其查询策略
+type listener struct {
+	address  string
+	protocol string
+	certFile string
+	keyFile  string
+	path     string
+	// 未匹配路由规则的查询使用的上游组，为 nil 时使用默认上游组
+	fallback *routeRule
+	queryLog bool
+	// 客户端访问控制列表，nil 表示允许所有客户端
+	acl *accessList
+}
+
+// String 返回监听的描述，用于日志输出
+func (l *listener) String() string {
+	return l.protocol + "://" + l.address
+}
+
+// listenerConfigs 返回配置的监听列表。未配置 server.listeners 时由 server.listen、tcp_listen、
+// disable_tcp、tls 与 https 生成
+func listenerConfigs(config *Config) []ListenerConfig {
+	if len(config.Server.Listeners) > 0 {
+		return config.Server.Listeners
+	}
+
+	server := config.Server
+	configs := []ListenerConfig{{Address: server.Listen, Protocol: protocolUDP}}
+	if !server.DisableTCP {
+		tcpAddr := server.TCPListen
+		if tcpAddr == "" {
+			tcpAddr = server.Listen
+		}
+		configs = append(configs, ListenerConfig{Address: tcpAddr, Protocol: protocolTCP})
+	}
+	if server.TLS.Listen != "" {
+		configs = append(configs, ListenerConfig{
+			Address:  server.TLS.Listen,
+			Protocol: protocolTLS,
+			CertFile: server.TLS.CertFile,
+			KeyFile:  server.TLS.KeyFile,
+		})
+	}
+	if server.HTTPS.Listen != "" {
+		configs = append(configs, ListenerConfig{
+			Address:  server.HTTPS.Listen,
+			Protocol: protocolHTTPS,
+			CertFile: server.HTTPS.CertFile,
+			KeyFile:  server.HTTPS.KeyFile,
+			Path:     server.HTTPS.Path,
+		})
+	}
+	return configs
+}
+
+// newListener 校验监听配置并解析其策略
+func (s *DNSServer) newListener(cfg ListenerConfig) (*listener, error) {
+	l := &listener{
+		address:  cfg.Address,
+		protocol: cfg.Protocol,
+		certFile: cfg.CertFile,
+		keyFile:  cfg.KeyFile,
+		path:     cfg.Path,
+		queryLog: cfg.Policy.QueryLog == nil || *cfg.Policy.QueryLog,
+		acl:      s.acl,
+	}
+	if l.protocol == "" {
+		l.protocol = protocolUDP
+	}
+	switch l.protocol {
+	case protocolUDP, protocolTCP, protocolTLS, protocolHTTPS:
+	default:
+		return nil, fmt.Errorf("listener %s: unknown protocol %q (use udp, tcp, tls or https)", cfg.Address, cfg.Protocol)
+	}
+	if l.address == "" {
+		return nil, fmt.Errorf("listener %s: address is required", l)
+	}
+
+	if cfg.Policy.Upstream != "" {
+		group, ok := s.dohClient.groups[cfg.Policy.Upstream]
+		if !ok {
+			return nil, fmt.Errorf("listener %s: unknown upstream group %q", l, cfg.Policy.Upstream)
+		}
+		l.fallback = &routeRule{group: group}
+	}
+	if cfg.Policy.AccessControl != nil {
+		acl, err := newAccessList(*cfg.Policy.AccessControl)
+		if err != nil {
+			return nil, fmt.Errorf("listener %s: %v", l, err)
+		}
+		l.acl = acl
+	}
+	return l, nil
+}
+
+// startListener 启动单个监听
+func (s *DNSServer) startListener(l *listener) error {
+	if l.protocol == protocolHTTPS {
+		return s.startHTTPS(l)
+	}
+
+	server := &dns.Server{
+		Addr: l.address,
+		Net:  l.protocol,
+		Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+			s.handleDNSRequest(l, w, req)
+		}),
+	}
+	// TCP 与 TLS 连接使用读写超时
+	if timeout := time.Duration(s.config.Server.Timeout) * time.Second; timeout > 0 && l.protocol != protocolUDP {
+		server.ReadTimeout = timeout
+		server.WriteTimeout = timeout
+	}
+	if l.protocol == protocolTLS {
+		// DNS-over-TLS 监听（RFC 7858），证书文件更新后自动重新加载
+		certs, err := newCertReloader(l.certFile, l.keyFile)
+		if err != nil {
+			return fmt.Errorf("DoT listener %s: %v", l.address, err)
+		}
+		server.Net = "tcp-tls"
+		server.TLSConfig = certs.tlsConfig()
+	}
+
+	if err := s.startServer(server); err != nil {
+		return err
+	}
+	s.logListener(l)
+	return nil
+}
+
+// logListener 输出监听地址及其策略
+func (s *DNSServer) logListener(l *listener) {
+	var policy string
+	if l.fallback != nil {
+		policy += ", upstream: " + l.fallback.group.name
+	}
+	if !l.queryLog {
+		policy += ", query log: off"
+	}
+	if l.acl != nil {
+		policy += ", ACL: " + l.acl.String()
+	}
+	if policy != "" {
+		policy = " (" + policy[2:] + ")"
+	}
+	log.Printf("Listening on %s%s", l, policy)
+}
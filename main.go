@@ -14,17 +14,77 @@ import (
 // Config 结构体定义配置文件结构
 type Config struct {
 	Server struct {
-		Listen  string `yaml:"listen"`
-		Timeout int    `yaml:"timeout"`
+		Listen     string `yaml:"listen"`
+		TCPListen  string `yaml:"tcp_listen"`
+		DisableTCP bool   `yaml:"disable_tcp"`
+		MaxUDPSize int    `yaml:"max_udp_size"`
+		Timeout    int    `yaml:"timeout"`
+		// 入站 DNS-over-HTTPS 服务器，listen 为空时不启用
+		HTTPS struct {
+			Listen   string `yaml:"listen"`
+			Path     string `yaml:"path"`
+			CertFile string `yaml:"cert_file"`
+			KeyFile  string `yaml:"key_file"`
+		} `yaml:"https"`
+		// 入站 DNS-over-TLS 监听，listen 为空时不启用
+		TLS struct {
+			Listen   string `yaml:"listen"`
+			CertFile string `yaml:"cert_file"`
+			KeyFile  string `yaml:"key_file"`
+		} `yaml:"tls"`
+		// 监听列表，配置后取代 listen、tcp_listen、disable_tcp、tls 与 https
+		Listeners     []ListenerConfig    `yaml:"listeners"`
+		AccessControl AccessControlConfig `yaml:"access_control"`
+		RateLimit     RateLimitConfig     `yaml:"rate_limit"`
 	} `yaml:"server"`
 	DoH struct {
-		Servers []struct {
-			URL  string `yaml:"url"`
-			Name string `yaml:"name"`
-		} `yaml:"servers"`
-		Timeout  int  `yaml:"timeout"`
-		UseHTTP2 bool `yaml:"use_http2"`
+		Servers          []DoHServerConfig `yaml:"servers"`
+		Strategy         string            `yaml:"strategy"`
+		Parallel         int               `yaml:"parallel"`
+		Timeout          int               `yaml:"timeout"`
+		UseHTTP2         bool              `yaml:"use_http2"`
+		UseHTTP3         bool              `yaml:"use_http3"`
+		AltSvc           bool              `yaml:"alt_svc"`
+		UserAgent        string            `yaml:"user_agent"`
+		Proxy            string            `yaml:"proxy"`
+		Padding          bool              `yaml:"padding"`
+		PaddingBlockSize int               `yaml:"padding_block_size"`
+		HealthCheck      struct {
+			Enabled          bool   `yaml:"enabled"`
+			Interval         int    `yaml:"interval"`
+			Name             string `yaml:"name"`
+			Type             string `yaml:"type"`
+			FailureThreshold int    `yaml:"failure_threshold"`
+			RecoveryTimeout  int    `yaml:"recovery_timeout"`
+		} `yaml:"health_check"`
 	} `yaml:"doh"`
+	Upstreams map[string]UpstreamGroupConfig `yaml:"upstreams"`
+	Routing   struct {
+		Default string            `yaml:"default"`
+		Rules   []RouteRuleConfig `yaml:"rules"`
+	} `yaml:"routing"`
+	Forward   []ForwardRuleConfig `yaml:"forward"`
+	Bootstrap struct {
+		Servers []string            `yaml:"servers"`
+		Hosts   map[string][]string `yaml:"hosts"`
+		Timeout int                 `yaml:"timeout"`
+	} `yaml:"bootstrap"`
+	ECS   ECSConfig `yaml:"ecs"`
+	Cache struct {
+		Enabled           bool   `yaml:"enabled"`
+		Size              int    `yaml:"size"`
+		MinTTL            int    `yaml:"min_ttl"`
+		MaxTTL            int    `yaml:"max_ttl"`
+		MaxNegativeTTL    int    `yaml:"max_negative_ttl"`
+		ServeStale        bool   `yaml:"serve_stale"`
+		StaleTTL          int    `yaml:"stale_ttl"`
+		MaxStale          int    `yaml:"max_stale"`
+		Prefetch          bool   `yaml:"prefetch"`
+		PrefetchThreshold int    `yaml:"prefetch_threshold"`
+		PrefetchMinHits   int    `yaml:"prefetch_min_hits"`
+		SnapshotPath      string `yaml:"snapshot_path"`
+		SnapshotInterval  int    `yaml:"snapshot_interval"`
+	} `yaml:"cache"`
 	TLS struct {
 		Enabled            bool     `yaml:"enabled"`
 		PrintCertInfo      bool     `yaml:"print_cert_info"`
@@ -62,6 +122,99 @@ type Config struct {
 	} `yaml:"logging"`
 }
 
+// DoHServerConfig 单个 DoH 服务器配置
+type DoHServerConfig struct {
+	URL         string            `yaml:"url"`
+	Name        string            `yaml:"name"`
+	Weight      int               `yaml:"weight"`
+	Timeout     int               `yaml:"timeout"`
+	Method      string            `yaml:"method"`
+	HTTPVersion string            `yaml:"http_version"`
+	Headers     map[string]string `yaml:"headers"`
+	UserAgent   string            `yaml:"user_agent"`
+	Format      string            `yaml:"format"`
+	IPs         []string          `yaml:"ips"`
+	Proxy       string            `yaml:"proxy"`
+}
+
+// ListenerConfig 监听配置，protocol 为 udp、tcp、tls 或 https，tls 与 https 需要证书与私钥
+type ListenerConfig struct {
+	Address  string               `yaml:"address"`
+	Protocol string               `yaml:"protocol"`
+	CertFile string               `yaml:"cert_file"`
+	KeyFile  string               `yaml:"key_file"`
+	Path     string               `yaml:"path"`
+	Policy   ListenerPolicyConfig `yaml:"policy"`
+}
+
+// ListenerPolicyConfig 监听的查询策略。upstream 为未匹配路由规则的查询使用的上游组（默认为 routing.default），
+// query_log 为 false 时不记录该监听的查询日志，access_control 取代全局的访问控制列表
+type ListenerPolicyConfig struct {
+	Upstream      string               `yaml:"upstream"`
+	QueryLog      *bool                `yaml:"query_log"`
+	AccessControl *AccessControlConfig `yaml:"access_control"`
+}
+
+// AccessControlConfig 客户端访问控制配置，action 为 refuse（返回 REFUSED）或 drop（不响应）
+type AccessControlConfig struct {
+	Allow  []string `yaml:"allow"`
+	Deny   []string `yaml:"deny"`
+	Action string   `yaml:"action"`
+}
+
+// RateLimitConfig 客户端限速配置。qps 为每个客户端网段（按 ipv4_prefix/ipv6_prefix 聚合）每秒允许的查询数，
+// 0 表示不限制；table_size 为查询与 RRL 令牌桶表各自的最大条目数；stats_interval 为输出限速计数的间隔（秒）
+type RateLimitConfig struct {
+	QPS           float64                 `yaml:"qps"`
+	Burst         int                     `yaml:"burst"`
+	IPv4Prefix    int                     `yaml:"ipv4_prefix"`
+	IPv6Prefix    int                     `yaml:"ipv6_prefix"`
+	Responses     ResponseRateLimitConfig `yaml:"responses"`
+	TableSize     int                     `yaml:"table_size"`
+	StatsInterval int                     `yaml:"stats_interval"`
+}
+
+// ResponseRateLimitConfig UDP 响应限速（RRL）配置。responses_per_second 为每个客户端网段每秒允许的相同响应数，
+// 0 表示不启用；slip 为每多少个被限速的响应中以 1 个 TC=1 的空响应代替，0 表示全部丢弃
+type ResponseRateLimitConfig struct {
+	ResponsesPerSecond float64 `yaml:"responses_per_second"`
+	Burst              int     `yaml:"burst"`
+	Slip               *int    `yaml:"slip"`
+}
+
+// ECSConfig EDNS Client Subnet 策略配置
+type ECSConfig struct {
+	Mode       string `yaml:"mode"`
+	IPv4Prefix int    `yaml:"ipv4_prefix"`
+	IPv6Prefix int    `yaml:"ipv6_prefix"`
+	Subnet     string `yaml:"subnet"`
+}
+
+// UpstreamGroupConfig 命名上游组配置，ECS 未配置时使用全局 ECS 策略
+type UpstreamGroupConfig struct {
+	Servers  []DoHServerConfig `yaml:"servers"`
+	Strategy string            `yaml:"strategy"`
+	Parallel int               `yaml:"parallel"`
+	ECS      *ECSConfig        `yaml:"ecs"`
+}
+
+// RouteRuleConfig 域名路由规则配置，domains 与 files 中的域名（含子域名）路由到 upstream 指定的上游组
+type RouteRuleConfig struct {
+	Name     string   `yaml:"name"`
+	Upstream string   `yaml:"upstream"`
+	Domains  []string `yaml:"domains"`
+	Files    []string `yaml:"files"`
+}
+
+// ForwardRuleConfig 条件转发规则配置，将指定域名后缀的查询转发到独立的上游组
+type ForwardRuleConfig struct {
+	Name     string            `yaml:"name"`
+	Domains  []string          `yaml:"domains"`
+	Servers  []DoHServerConfig `yaml:"servers"`
+	Strategy string            `yaml:"strategy"`
+	ECS      *ECSConfig        `yaml:"ecs"`
+}
+
 var (
 	config     Config
 	configFile string
@@ -98,11 +251,6 @@ func main() {
 
 	// 设置日志级别
 	log.Printf("DNS to DoH converter starting...")
-	log.Printf("Listen address: %s", config.Server.Listen)
-	log.Printf("Configured %d DoH servers:", len(config.DoH.Servers))
-	for i, server := range config.DoH.Servers {
-		log.Printf("  [%d] %s - %s", i+1, server.Name, server.URL)
-	}
 
 	// 初始化 TLS 配置管理器
 	tlsManager := NewTLSConfigManager(&config)
@@ -118,10 +266,31 @@ func main() {
 	defer queryLogger.Close()
 
 	// 初始化 DoH 客户端
-	dohClient := NewDoHClient(&config, tlsManager)
+	dohClient, err := NewDoHClient(&config, tlsManager)
+	if err != nil {
+		log.Fatalf("Failed to initialize upstreams: %v", err)
+	}
+	defer dohClient.Close()
+	for _, group := range dohClient.groupOrder {
+		log.Printf("Upstream group %s (strategy: %s, ECS: %s):", group.name, group.selector.strategy, group.ecs)
+		for i, u := range group.selector.upstreams {
+			log.Printf("  [%d] %s - %s", i+1, u.config.Name, u.config.URL)
+		}
+	}
+	for _, rule := range dohClient.router.rules {
+		log.Printf("Routing rule %s: %d domains -> %s", rule.name, rule.domains, rule.group.name)
+	}
+	log.Printf("Default upstream group: %s", dohClient.defaultGroup.name)
+
+	// 初始化响应缓存
+	var cache *DNSCache
+	if config.Cache.Enabled {
+		cache = NewDNSCache(&config)
+		log.Printf("Response cache enabled (size: %d)", cache.size)
+	}
 
 	// 启动 DNS 服务器
-	dnsServer := NewDNSServer(&config, dohClient, queryLogger)
+	dnsServer := NewDNSServer(&config, dohClient, cache, queryLogger)
 	if err := dnsServer.Start(); err != nil {
 		log.Fatalf("Failed to start DNS server: %v", err)
 	}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultPaddingBlockSize RFC 8467 建议查询按 128 字节的块长度填充
+	defaultPaddingBlockSize = 128
+	// responsePaddingBlockSize RFC 8467 建议响应按 468 字节的块长度填充
+	responsePaddingBlockSize = 468
+)
+
+// paddingBlockSize 返回配置的填充块长度，未启用填充时返回 0
+func paddingBlockSize(config *Config) int {
+	if !config.DoH.Padding {
+		return 0
+	}
+	if config.DoH.PaddingBlockSize > 0 {
+		return config.DoH.PaddingBlockSize
+	}
+	return defaultPaddingBlockSize
+}
+
+// isEncryptedServer 判断服务器是否使用加密传输（https://、tls://、quic://），仅这些服务器的查询需要填充
+func isEncryptedServer(server *DoHServerConfig) bool {
+	return strings.HasPrefix(server.URL, "https://") ||
+		strings.HasPrefix(server.URL, schemeDoT) ||
+		strings.HasPrefix(server.URL, schemeDoQ)
+}
+
+// padMessage 按 RFC 7830 添加 EDNS(0) Padding 选项，使消息长度为 block 的整数倍（RFC 8467 块长度策略）。
+// 消息未携带 OPT 记录时添加一个
+func padMessage(msg *dns.Msg, block int) {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		msg.SetEdns0(edns0UDPSize, false)
+		opt = msg.IsEdns0()
+	}
+	removeEDNS0Option(opt, dns.EDNS0PADDING)
+
+	padding := &dns.EDNS0_PADDING{}
+	opt.Option = append(opt.Option, padding)
+	if rem := msg.Len() % block; rem != 0 {
+		padding.Padding = make([]byte, block-rem)
+	}
+}
+
+// shrinkPadding 从 OPT 记录的填充选项中去掉 n 字节，为其他选项腾出空间。
+// 未填充时返回 true，填充不足 n 字节时不修改并返回 false
+func shrinkPadding(opt *dns.OPT, n int) bool {
+	for _, o := range opt.Option {
+		if padding, ok := o.(*dns.EDNS0_PADDING); ok {
+			if len(padding.Padding) < n {
+				return false
+			}
+			padding.Padding = padding.Padding[:len(padding.Padding)-n]
+			return true
+		}
+	}
+	return true
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	schemeUDP           = "udp://"
+	schemeTCP           = "tcp://"
+	defaultPlainDNSPort = "53"
+)
+
+// plainTransport 明文 DNS（UDP/TCP）上游传输，用于转发内部区域到本地 DNS 服务器
+type plainTransport struct {
+	addr      string
+	net       string
+	bootstrap *bootstrapResolver
+	// TCP 查询通过代理建立连接，为 nil 时直接连接
+	dial dialFunc
+}
+
+// newPlainTransport 根据 udp://host[:port] 或 tcp://host[:port] 地址创建明文 DNS 传输
+func newPlainTransport(serverURL string, bootstrap *bootstrapResolver, dial dialFunc) (*plainTransport, error) {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid DNS server URL: %v", err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid DNS server URL: missing host")
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultPlainDNSPort
+	}
+
+	return &plainTransport{
+		addr:      net.JoinHostPort(u.Hostname(), port),
+		net:       u.Scheme,
+		bootstrap: bootstrap,
+		dial:      dial,
+	}, nil
+}
+
+// exchange 发送查询，UDP 响应被截断时改用 TCP 重试
+func (t *plainTransport) exchange(ctx context.Context, packed []byte) (*dns.Msg, error) {
+	req := new(dns.Msg)
+	if err := req.Unpack(packed); err != nil {
+		return nil, fmt.Errorf("failed to parse DNS query: %v", err)
+	}
+
+	if t.net == "tcp" && t.dial != nil {
+		return t.exchangeDial(ctx, req)
+	}
+
+	addr, err := t.bootstrap.resolveAddr(ctx, t.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve DNS server %s: %v", t.addr, err)
+	}
+
+	client := &dns.Client{Net: t.net}
+	resp, _, err := client.ExchangeContext(ctx, req, addr)
+	if err == nil && resp.Truncated && t.net == "udp" {
+		client.Net = "tcp"
+		resp, _, err = client.ExchangeContext(ctx, req, addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("DNS query to %s/%s failed: %v", t.net, t.addr, err)
+	}
+	return resp, nil
+}
+
+// exchangeDial 通过代理连接发送 TCP 查询
+func (t *plainTransport) exchangeDial(ctx context.Context, req *dns.Msg) (*dns.Msg, error) {
+	conn, err := t.dial(ctx, "tcp", t.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to DNS server %s: %v", t.addr, err)
+	}
+	defer conn.Close()
+
+	client := &dns.Client{Net: "tcp"}
+	resp, _, err := client.ExchangeWithConnContext(ctx, req, &dns.Conn{Conn: conn})
+	if err != nil {
+		return nil, fmt.Errorf("DNS query to tcp/%s failed: %v", t.addr, err)
+	}
+	return resp, nil
+}
+
+// close 明文传输不保持连接
+func (t *plainTransport) close() {}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// proxyDirect 服务器级 proxy 设置为该值时不使用全局代理
+const proxyDirect = "direct"
+
+// Dial 使 dialFunc 满足 proxy.Dialer 接口
+func (d dialFunc) Dial(network, addr string) (net.Conn, error) {
+	return d(context.Background(), network, addr)
+}
+
+// DialContext 使 dialFunc 满足 proxy.ContextDialer 接口
+func (d dialFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return d(ctx, network, addr)
+}
+
+// newProxyDial 创建通过代理建立 TCP 连接的拨号函数，支持 socks5://、socks5h:// 与 http(s):// CONNECT 代理，
+// 代理服务器地址本身通过引导解析器解析
+func newProxyDial(proxyURL string, bootstrap *bootstrapResolver) (dialFunc, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %v", err)
+	}
+	if u.Hostname() == "" {
+		return nil, fmt.Errorf("invalid proxy URL: missing host")
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		addr := hostPortDefault(u, "1080")
+		socks, err := proxy.SOCKS5("tcp", addr, auth, dialFunc(bootstrap.dial))
+		if err != nil {
+			return nil, fmt.Errorf("invalid SOCKS5 proxy: %v", err)
+		}
+		dialer := socks.(proxy.ContextDialer)
+
+		// socks5h 由代理解析目标主机名，socks5 在本地通过引导解析器解析后发送 IP 地址
+		if u.Scheme == "socks5h" {
+			return dialer.DialContext, nil
+		}
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			host, port, err := net.SplitHostPort(addr)
+			if err != nil {
+				return nil, err
+			}
+			ips, err := bootstrap.lookup(ctx, host)
+			if err != nil {
+				return nil, err
+			}
+			var lastErr error
+			for _, ip := range ips {
+				conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+				if err == nil {
+					return conn, nil
+				}
+				lastErr = err
+				if ctx.Err() != nil {
+					break
+				}
+			}
+			if lastErr == nil {
+				lastErr = fmt.Errorf("no addresses for %s", host)
+			}
+			return nil, lastErr
+		}, nil
+
+	case "http", "https":
+		defaultPort := "80"
+		if u.Scheme == "https" {
+			defaultPort = "443"
+		}
+		p := &connectProxy{
+			addr:      hostPortDefault(u, defaultPort),
+			user:      u.User,
+			bootstrap: bootstrap,
+		}
+		if u.Scheme == "https" {
+			p.tlsConfig = &tls.Config{ServerName: u.Hostname()}
+		}
+		return p.dial, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q (use socks5, socks5h or http)", u.Scheme)
+	}
+}
+
+// hostPortDefault 返回 URL 的 host:port，未指定端口时使用默认端口
+func hostPortDefault(u *url.URL, defaultPort string) string {
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// connectProxy HTTP CONNECT 代理
+type connectProxy struct {
+	addr      string
+	user      *url.Userinfo
+	tlsConfig *tls.Config
+	bootstrap *bootstrapResolver
+}
+
+// dial 连接代理并通过 CONNECT 建立到目标地址的隧道
+func (p *connectProxy) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := p.bootstrap.dial(ctx, "tcp", p.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to proxy %s: %v", p.addr, err)
+	}
+	if p.tlsConfig != nil {
+		tlsConn := tls.Client(conn, p.tlsConfig)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("TLS handshake with proxy %s failed: %v", p.addr, err)
+		}
+		conn = tlsConn
+	}
+
+	// 握手期间遵循请求的超时
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if p.user != nil {
+		password, _ := p.user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(p.user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send CONNECT to proxy %s: %v", p.addr, err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to read CONNECT response from proxy %s: %v", p.addr, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s refused CONNECT to %s: %s", p.addr, addr, resp.Status)
+	}
+
+	// 代理在 200 响应后已发送的数据保留在缓冲区中
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn 先读取缓冲区中剩余数据的连接
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// redactProxyURL 隐藏代理 URL 中的密码，用于日志输出
+func redactProxyURL(proxyURL string) string {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return proxyURL
+	}
+	return u.Redacted()
+}
@@ -27,6 +27,9 @@ type QueryLogEntry struct {
 	Answers      []AnswerEntry `json:"answers,omitempty"`
 	Duration     int64         `json:"duration_ms"`
 	DoHServer    string        `json:"doh_server"`
+	Rule         string        `json:"rule,omitempty"`
+	// Transport the query arrived over: udp, tcp, tls or https
+	Transport string `json:"transport"`
 }
 
 // AnswerEntry represents a single DNS answer record
@@ -51,7 +54,7 @@ func NewConsoleLogger() *ConsoleLogger {
 }
 
 func (l *ConsoleLogger) Log(entry QueryLogEntry) error {
-	log.Printf("Query received: %s (type: %s) from: %s", entry.Domain, entry.QueryType, entry.ClientIP)
+	log.Printf("Query received: %s (type: %s) from: %s (%s)", entry.Domain, entry.QueryType, entry.ClientIP, entry.Transport)
 	if entry.AnswerCount > 0 {
 		log.Printf("Query successful: %s -> %d answers (elapsed: %dms)", entry.Domain, entry.AnswerCount, entry.Duration)
 	}
@@ -96,7 +99,7 @@ func NewFileLogger(config *Config) (*FileLogger, error) {
 	} else if fl.format == "csv" {
 		fl.csvWriter = csv.NewWriter(logger)
 		// Write CSV header
-		fl.csvWriter.Write([]string{"Timestamp", "ClientIP", "Domain", "QueryType", "ResponseCode", "AnswerCount", "Answers", "DurationMs", "DoHServer"})
+		fl.csvWriter.Write([]string{"Timestamp", "ClientIP", "Domain", "QueryType", "ResponseCode", "AnswerCount", "Answers", "DurationMs", "DoHServer", "Rule", "Transport"})
 		fl.csvWriter.Flush()
 	}
 
@@ -127,6 +130,8 @@ func (l *FileLogger) Log(entry QueryLogEntry) error {
 			answersJSON,
 			fmt.Sprintf("%d", entry.Duration),
 			entry.DoHServer,
+			entry.Rule,
+			entry.Transport,
 		}
 		if err := l.csvWriter.Write(record); err != nil {
 			return err
@@ -218,6 +223,8 @@ func (l *DatabaseLogger) createTable() error {
 			answers TEXT,
 			duration_ms INTEGER NOT NULL,
 			doh_server TEXT NOT NULL,
+			rule TEXT,
+			transport TEXT,
 			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
 		);
 		CREATE INDEX IF NOT EXISTS idx_timestamp ON query_logs(timestamp);
@@ -237,6 +244,8 @@ func (l *DatabaseLogger) createTable() error {
 			answers TEXT,
 			duration_ms INTEGER NOT NULL,
 			doh_server VARCHAR(255) NOT NULL,
+			rule VARCHAR(255),
+			transport VARCHAR(10),
 			created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 		);
 		CREATE INDEX IF NOT EXISTS idx_timestamp ON query_logs(timestamp);
@@ -245,7 +254,33 @@ func (l *DatabaseLogger) createTable() error {
 		`
 	}
 
-	_, err := l.db.Exec(createTableSQL)
+	if _, err := l.db.Exec(createTableSQL); err != nil {
+		return err
+	}
+
+	// Add columns introduced after the table was first created
+	if err := l.addColumn("rule", "TEXT"); err != nil {
+		return err
+	}
+	return l.addColumn("transport", "TEXT")
+}
+
+// addColumn adds a column to an existing query_logs table if it is missing
+func (l *DatabaseLogger) addColumn(name, columnType string) error {
+	if l.dbType != "sqlite" {
+		_, err := l.db.Exec(fmt.Sprintf("ALTER TABLE query_logs ADD COLUMN IF NOT EXISTS %s %s", name, columnType))
+		return err
+	}
+
+	// SQLite has no ADD COLUMN IF NOT EXISTS
+	var count int
+	if err := l.db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('query_logs') WHERE name = ?", name).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return nil
+	}
+	_, err := l.db.Exec(fmt.Sprintf("ALTER TABLE query_logs ADD COLUMN %s %s", name, columnType))
 	return err
 }
 
@@ -261,13 +296,13 @@ func (l *DatabaseLogger) Log(entry QueryLogEntry) error {
 	}
 
 	query := `INSERT INTO query_logs 
-		(timestamp, client_ip, domain, query_type, response_code, answer_count, answers, duration_ms, doh_server)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+		(timestamp, client_ip, domain, query_type, response_code, answer_count, answers, duration_ms, doh_server, rule, transport)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
 
 	if l.dbType == "sqlite" {
 		query = `INSERT INTO query_logs 
-			(timestamp, client_ip, domain, query_type, response_code, answer_count, answers, duration_ms, doh_server)
-			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`
+			(timestamp, client_ip, domain, query_type, response_code, answer_count, answers, duration_ms, doh_server, rule, transport)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
 	}
 
 	_, err := l.db.Exec(query,
@@ -280,6 +315,8 @@ func (l *DatabaseLogger) Log(entry QueryLogEntry) error {
 		answersJSON,
 		entry.Duration,
 		entry.DoHServer,
+		entry.Rule,
+		entry.Transport,
 	)
 
 	return err
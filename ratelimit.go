@@ -0,0 +1,302 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"math"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultRateLimitIPv4Prefix = 32
+	defaultRateLimitIPv6Prefix = 56
+	// defaultRRLSlip 默认每 2 个被限速的响应中有 1 个以 TC=1 的空响应代替（与 BIND 相同）
+	defaultRRLSlip = 2
+	// defaultRateLimitStatsInterval 输出限速计数的默认间隔（秒）
+	defaultRateLimitStatsInterval = 300
+	// defaultRateLimitTableSize 每个令牌桶表的默认最大条目数（类似 BIND 的 max-table-size）
+	defaultRateLimitTableSize = 100000
+	// rateLimitSweepBatch 每次调用 allow 时最多清理的已回满令牌桶数量
+	rateLimitSweepBatch = 2
+)
+
+// rrlAction 响应限速（RRL）的处理结果
+type rrlAction int
+
+const (
+	rrlPass rrlAction = iota
+	rrlDrop
+	rrlSlip
+)
+
+// String 返回处理结果的名称，用于调试日志
+func (a rrlAction) String() string {
+	switch a {
+	case rrlDrop:
+		return "dropped"
+	case rrlSlip:
+		return "slipped"
+	}
+	return "passed"
+}
+
+// tokenBucket 令牌桶，tokens 为 last 时刻的令牌数，denied 为令牌不足而被拒绝的次数
+type tokenBucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+	denied uint64
+}
+
+// bucketSet 按键维护令牌桶，每秒补充 rate 个令牌，最多 burst 个。
+// 桶按最近使用排序，条目数达到 size 时淘汰最久未使用的桶，伪造源地址的洪水查询不会使表无限增长
+type bucketSet struct {
+	rate  float64
+	burst float64
+	// fillTime 空桶回满所需的时间，闲置超过该时间的桶与新建的桶等价
+	fillTime time.Duration
+	size     int
+
+	mu      sync.Mutex
+	buckets map[string]*list.Element
+	lru     *list.List
+}
+
+// newBucketSet 创建令牌桶集合，rate 为 0 时返回 nil（不限速）。burst 为 0 时使用 2 倍 rate，
+// size 为 0 时使用 defaultRateLimitTableSize
+func newBucketSet(rate float64, burst int, size int) *bucketSet {
+	if rate <= 0 {
+		return nil
+	}
+	b := &bucketSet{rate: rate, burst: float64(burst), size: size, buckets: make(map[string]*list.Element), lru: list.New()}
+	if burst <= 0 {
+		b.burst = math.Max(1, math.Ceil(2*rate))
+	}
+	if size <= 0 {
+		b.size = defaultRateLimitTableSize
+	}
+	b.fillTime = time.Duration(b.burst / rate * float64(time.Second))
+	return b
+}
+
+// allow 从 key 对应的令牌桶中取出一个令牌，令牌不足时返回 false 及该桶累计被拒绝的次数
+func (b *bucketSet) allow(key string) (bool, uint64) {
+	return b.allowAt(key, time.Now())
+}
+
+// allowAt 按时间 now 执行 allow
+func (b *bucketSet) allowAt(key string, now time.Time) (bool, uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.sweep(now)
+
+	var bucket *tokenBucket
+	if elem, ok := b.buckets[key]; ok {
+		bucket = elem.Value.(*tokenBucket)
+		bucket.tokens = math.Min(b.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*b.rate)
+		bucket.last = now
+		b.lru.MoveToFront(elem)
+	} else {
+		if b.lru.Len() >= b.size {
+			b.remove(b.lru.Back())
+		}
+		bucket = &tokenBucket{key: key, tokens: b.burst, last: now}
+		b.buckets[key] = b.lru.PushFront(bucket)
+	}
+	if bucket.tokens < 1 {
+		bucket.denied++
+		return false, bucket.denied
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// sweep 从最久未使用的一端删除最多 rateLimitSweepBatch 个已回满的令牌桶，清理开销分摊到每次调用。
+// 调用方需持有锁
+func (b *bucketSet) sweep(now time.Time) {
+	for i := 0; i < rateLimitSweepBatch; i++ {
+		elem := b.lru.Back()
+		if elem == nil || now.Sub(elem.Value.(*tokenBucket).last) < b.fillTime {
+			return
+		}
+		b.remove(elem)
+	}
+}
+
+// remove 删除令牌桶，调用方需持有锁
+func (b *bucketSet) remove(elem *list.Element) {
+	b.lru.Remove(elem)
+	delete(b.buckets, elem.Value.(*tokenBucket).key)
+}
+
+// rateLimiter 按客户端地址前缀限制查询速率，并对 UDP 响应执行 RRL，
+// 超出速率的相同响应被丢弃或以 TC=1 的空响应代替（slip），防止被用于反射放大攻击
+type rateLimiter struct {
+	ipv4Prefix int
+	ipv6Prefix int
+	// 客户端查询令牌桶，nil 表示不限制查询速率
+	queries *bucketSet
+	// 相同响应令牌桶，nil 表示不启用 RRL
+	responses *bucketSet
+	slip      uint64
+
+	// 累计计数：被限速的查询、被丢弃的响应与以 TC=1 代替的响应
+	limited atomic.Uint64
+	dropped atomic.Uint64
+	slipped atomic.Uint64
+	statsMu sync.Mutex
+	logged  [3]uint64
+	stop    chan struct{}
+}
+
+// newRateLimiter 根据配置创建限速器，查询限速与 RRL 均未启用时返回 nil
+func newRateLimiter(cfg RateLimitConfig) (*rateLimiter, error) {
+	if cfg.QPS < 0 || cfg.Responses.ResponsesPerSecond < 0 || cfg.TableSize < 0 {
+		return nil, fmt.Errorf("rate limit must not be negative")
+	}
+	r := &rateLimiter{
+		ipv4Prefix: cfg.IPv4Prefix,
+		ipv6Prefix: cfg.IPv6Prefix,
+		queries:    newBucketSet(cfg.QPS, cfg.Burst, cfg.TableSize),
+		responses:  newBucketSet(cfg.Responses.ResponsesPerSecond, cfg.Responses.Burst, cfg.TableSize),
+		slip:       defaultRRLSlip,
+	}
+	if r.queries == nil && r.responses == nil {
+		return nil, nil
+	}
+	if r.ipv4Prefix == 0 {
+		r.ipv4Prefix = defaultRateLimitIPv4Prefix
+	}
+	if r.ipv6Prefix == 0 {
+		r.ipv6Prefix = defaultRateLimitIPv6Prefix
+	}
+	if r.ipv4Prefix < 0 || r.ipv4Prefix > 32 || r.ipv6Prefix < 0 || r.ipv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid rate limit prefix length (ipv4_prefix: 1-32, ipv6_prefix: 1-128)")
+	}
+	if cfg.Responses.Slip != nil {
+		if *cfg.Responses.Slip < 0 {
+			return nil, fmt.Errorf("rate limit slip must not be negative")
+		}
+		r.slip = uint64(*cfg.Responses.Slip)
+	}
+	return r, nil
+}
+
+// key 返回客户端地址按配置前缀长度聚合后的网段
+func (r *rateLimiter) key(addr netip.Addr) string {
+	bits := r.ipv6Prefix
+	if addr.Is4() {
+		bits = r.ipv4Prefix
+	}
+	prefix, _ := addr.Prefix(bits)
+	return prefix.String()
+}
+
+// allowQuery 判断是否允许客户端的查询。nil 限速器或未知客户端地址不限速
+func (r *rateLimiter) allowQuery(addr netip.Addr) bool {
+	if r == nil || r.queries == nil || !addr.IsValid() {
+		return true
+	}
+	if ok, _ := r.queries.allow(r.key(addr)); ok {
+		return true
+	}
+	r.limited.Add(1)
+	return false
+}
+
+// limitResponse 对发往客户端的响应执行 RRL。相同响应按客户端网段、响应码与名称计数：
+// 有应答时为查询名称与类型，NXDOMAIN 与无应答时为 SOA 所在的区域，其他错误响应共用一个计数。
+// 与 BIND 相同，slip 按每个计数各自被限速的响应数决定，不受其他客户端影响
+func (r *rateLimiter) limitResponse(addr netip.Addr, resp *dns.Msg) rrlAction {
+	if r == nil || r.responses == nil || !addr.IsValid() || len(resp.Question) == 0 {
+		return rrlPass
+	}
+
+	var name string
+	switch {
+	case resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError:
+	case resp.Rcode == dns.RcodeSuccess && len(resp.Answer) > 0:
+		name = strings.ToLower(resp.Question[0].Name) + "/" + dns.TypeToString[resp.Question[0].Qtype]
+	default:
+		name = strings.ToLower(resp.Question[0].Name)
+		for _, rr := range resp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				name = strings.ToLower(soa.Hdr.Name)
+				break
+			}
+		}
+	}
+	ok, denied := r.responses.allow(r.key(addr) + "|" + dns.RcodeToString[resp.Rcode] + "|" + name)
+	if ok {
+		return rrlPass
+	}
+	if r.slip > 0 && denied%r.slip == 0 {
+		r.slipped.Add(1)
+		return rrlSlip
+	}
+	r.dropped.Add(1)
+	return rrlDrop
+}
+
+// String 返回限速配置的描述，用于日志输出
+func (r *rateLimiter) String() string {
+	var parts []string
+	if r.queries != nil {
+		parts = append(parts, fmt.Sprintf("%g queries/s (burst %g)", r.queries.rate, r.queries.burst))
+	}
+	if r.responses != nil {
+		parts = append(parts, fmt.Sprintf("RRL %g responses/s (burst %g, slip %d)", r.responses.rate, r.responses.burst, r.slip))
+	}
+	return fmt.Sprintf("%s per /%d (IPv4) or /%d (IPv6)", strings.Join(parts, ", "), r.ipv4Prefix, r.ipv6Prefix)
+}
+
+// start 每隔 interval 输出一次限速计数（计数有变化时），interval 不大于 0 时不输出
+func (r *rateLimiter) start(interval time.Duration) {
+	r.stop = make(chan struct{})
+	if interval <= 0 {
+		return
+	}
+	go func(stop chan struct{}) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.logStats()
+			case <-stop:
+				return
+			}
+		}
+	}(r.stop)
+}
+
+// close 停止定期输出并输出最终计数
+func (r *rateLimiter) close() {
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	r.stop = nil
+	r.logStats()
+}
+
+// logStats 输出累计的限速计数，自上次输出以来没有变化时跳过
+func (r *rateLimiter) logStats() {
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+
+	counts := [3]uint64{r.limited.Load(), r.dropped.Load(), r.slipped.Load()}
+	if counts == r.logged {
+		return
+	}
+	r.logged = counts
+	log.Printf("Rate limiting: %d queries limited, %d responses dropped, %d responses slipped", counts[0], counts[1], counts[2])
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestBucketSetAllow(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	// step 为相对 start 的时间与期望结果
+	type step struct {
+		at   time.Duration
+		want bool
+	}
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		steps []step
+	}{
+		{
+			name:  "burst then deny",
+			rate:  1,
+			burst: 3,
+			steps: []step{{0, true}, {0, true}, {0, true}, {0, false}, {0, false}},
+		},
+		{
+			name:  "refill over time",
+			rate:  2,
+			burst: 1,
+			steps: []step{{0, true}, {0, false}, {250 * time.Millisecond, false}, {500 * time.Millisecond, true}, {500 * time.Millisecond, false}},
+		},
+		{
+			name:  "refill is capped at burst",
+			rate:  10,
+			burst: 2,
+			steps: []step{{0, true}, {0, true}, {time.Hour, true}, {time.Hour, true}, {time.Hour, false}},
+		},
+		{
+			name:  "default burst is twice the rate",
+			rate:  1.5,
+			steps: []step{{0, true}, {0, true}, {0, true}, {0, false}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBucketSet(tt.rate, tt.burst, 0)
+			for i, s := range tt.steps {
+				if got, _ := b.allowAt("client", start.Add(s.at)); got != s.want {
+					t.Fatalf("step %d at %v: allow = %v, want %v", i, s.at, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+func TestBucketSetDeniedCount(t *testing.T) {
+	now := time.Now()
+	b := newBucketSet(1, 1, 0)
+	b.allowAt("a", now)
+	b.allowAt("b", now)
+	for want := uint64(1); want <= 3; want++ {
+		if ok, denied := b.allowAt("a", now); ok || denied != want {
+			t.Fatalf("a: allow = %v, denied = %d, want false, %d", ok, denied, want)
+		}
+	}
+	// 其他桶的拒绝次数独立计数
+	if ok, denied := b.allowAt("b", now); ok || denied != 1 {
+		t.Fatalf("b: allow = %v, denied = %d, want false, 1", ok, denied)
+	}
+}
+
+func TestBucketSetEviction(t *testing.T) {
+	now := time.Now()
+	b := newBucketSet(1, 1, 3)
+	for _, key := range []string{"a", "b", "c"} {
+		b.allowAt(key, now)
+	}
+	// 使用 a 后 b 成为最久未使用的桶，表满时被淘汰
+	b.allowAt("a", now)
+	b.allowAt("d", now)
+
+	if n := b.lru.Len(); n != 3 {
+		t.Fatalf("table size = %d, want 3", n)
+	}
+	if _, ok := b.buckets["b"]; ok {
+		t.Error("least recently used bucket b was not evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, ok := b.buckets[key]; !ok {
+			t.Errorf("bucket %s was evicted", key)
+		}
+	}
+	// 被淘汰的桶重新创建时令牌是满的
+	if ok, _ := b.allowAt("b", now); !ok {
+		t.Error("recreated bucket b has no tokens")
+	}
+}
+
+func TestBucketSetSweep(t *testing.T) {
+	now := time.Now()
+	// 空桶 2 秒回满
+	b := newBucketSet(1, 2, 0)
+	for _, key := range []string{"a", "b", "c", "d"} {
+		b.allowAt(key, now)
+	}
+
+	// 未回满的桶保留
+	b.allowAt("e", now.Add(time.Second))
+	if n := b.lru.Len(); n != 5 {
+		t.Fatalf("table size = %d, want 5", n)
+	}
+
+	// 每次调用最多清理 rateLimitSweepBatch 个已回满的桶
+	b.allowAt("e", now.Add(3*time.Second))
+	if n := b.lru.Len(); n != 5-rateLimitSweepBatch {
+		t.Fatalf("table size = %d, want %d", n, 5-rateLimitSweepBatch)
+	}
+	b.allowAt("e", now.Add(3*time.Second))
+	if n := b.lru.Len(); n != 1 {
+		t.Fatalf("table size = %d, want 1", n)
+	}
+}
+
+func TestRateLimiterSlip(t *testing.T) {
+	slip := 3
+	r, err := newRateLimiter(RateLimitConfig{Responses: ResponseRateLimitConfig{ResponsesPerSecond: 0.001, Burst: 1, Slip: &slip}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := new(dns.Msg)
+	resp.SetQuestion("example.test.", dns.TypeA)
+	rr, _ := dns.NewRR("example.test. 60 IN A 192.0.2.1")
+	resp.Answer = append(resp.Answer, rr)
+
+	a := netip.MustParseAddr("192.0.2.10")
+	b := netip.MustParseAddr("198.51.100.10")
+	want := []rrlAction{rrlPass, rrlDrop, rrlDrop, rrlSlip, rrlDrop, rrlDrop, rrlSlip}
+	for i, w := range want {
+		if got := r.limitResponse(a, resp); got != w {
+			t.Fatalf("client a response %d: %v, want %v", i, got, w)
+		}
+		// 另一个客户端的响应不影响 a 的 slip 节奏
+		if i == 2 {
+			for j, w := range []rrlAction{rrlPass, rrlDrop} {
+				if got := r.limitResponse(b, resp); got != w {
+					t.Fatalf("client b response %d: %v, want %v", j, got, w)
+				}
+			}
+		}
+	}
+	if dropped, slipped := r.dropped.Load(), r.slipped.Load(); dropped != 5 || slipped != 2 {
+		t.Errorf("dropped = %d, slipped = %d, want 5, 2", dropped, slipped)
+	}
+}
+
+func TestRateLimiterPrefixAggregation(t *testing.T) {
+	r, err := newRateLimiter(RateLimitConfig{QPS: 0.001, Burst: 1, IPv4Prefix: 24, IPv6Prefix: 56})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"192.0.2.1", true},
+		{"192.0.2.200", false},
+		{"192.0.3.1", true},
+		{"2001:db8:0:1::1", true},
+		{"2001:db8:0:ff::1", false},
+		{"2001:db8:0:100::1", true},
+	}
+	for _, tt := range tests {
+		if got := r.allowQuery(netip.MustParseAddr(tt.addr)); got != tt.want {
+			t.Errorf("allowQuery(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+	if limited := r.limited.Load(); limited != 2 {
+		t.Errorf("limited = %d, want 2", limited)
+	}
+}
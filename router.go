@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// routeRule 域名路由规则，匹配的查询发送到规则指定的上游组
+type routeRule struct {
+	name  string
+	group *upstreamGroup
+	// 规则实际生效的域名数量
+	domains int
+}
+
+// router 按域名后缀将查询路由到上游组，未匹配的查询使用默认组
+type router struct {
+	// 按配置顺序排列的规则
+	rules []*routeRule
+	trie  domainTrie
+}
+
+// newRouter 根据路由规则与条件转发规则创建路由器
+func newRouter(client *DoHClient) (*router, error) {
+	r := &router{}
+
+	for i, cfg := range client.config.Routing.Rules {
+		name := cfg.Name
+		if name == "" {
+			name = fmt.Sprintf("rule-%d", i+1)
+		}
+		group, ok := client.groups[cfg.Upstream]
+		if !ok {
+			return nil, fmt.Errorf("routing rule %s: unknown upstream group %q", name, cfg.Upstream)
+		}
+
+		domains := append([]string(nil), cfg.Domains...)
+		for _, path := range cfg.Files {
+			list, err := loadDomainList(path)
+			if err != nil {
+				return nil, fmt.Errorf("routing rule %s: %v", name, err)
+			}
+			domains = append(domains, list...)
+		}
+		r.addRule(&routeRule{name: name, group: group}, domains)
+	}
+
+	// 条件转发规则使用各自内联的上游服务器
+	for i, cfg := range client.config.Forward {
+		name := cfg.Name
+		if name == "" && len(cfg.Domains) > 0 {
+			name = normalizeDomain(cfg.Domains[0])
+		}
+		if len(cfg.Servers) == 0 || len(cfg.Domains) == 0 {
+			log.Printf("[WARNING] Forward rule #%d (%s) needs at least one domain and one server, ignored", i+1, name)
+			continue
+		}
+		group, err := client.newUpstreamGroup(name, UpstreamGroupConfig{Servers: cfg.Servers, Strategy: cfg.Strategy, ECS: cfg.ECS})
+		if err != nil {
+			return nil, fmt.Errorf("forward rule %s: %v", name, err)
+		}
+		r.addRule(&routeRule{name: name, group: group}, cfg.Domains)
+	}
+
+	return r, nil
+}
+
+// addRule 将规则的域名加入前缀树，已被其他规则占用的域名保留先配置的规则
+func (r *router) addRule(rule *routeRule, domains []string) {
+	added, duplicates := 0, 0
+	for _, domain := range domains {
+		suffix := normalizeDomain(domain)
+		if suffix == "." {
+			log.Printf("[WARNING] Routing rule %s: the root domain cannot be routed, use routing.default instead", rule.name)
+			continue
+		}
+		if existing := r.trie.insert(suffix, rule); existing != rule {
+			if existing != nil {
+				duplicates++
+			}
+			continue
+		}
+		added++
+	}
+	if duplicates > 0 {
+		log.Printf("[WARNING] Routing rule %s: %d domains already matched by earlier rules were skipped", rule.name, duplicates)
+	}
+	rule.domains = added
+	r.rules = append(r.rules, rule)
+}
+
+// match 返回与查询名称最长后缀匹配的规则，未匹配时返回 nil
+func (r *router) match(qname string) *routeRule {
+	return r.trie.match(strings.ToLower(dns.Fqdn(qname)))
+}
+
+// domainTrie 按标签从右向左组织的域名后缀树
+type domainTrie struct {
+	root trieNode
+}
+
+type trieNode struct {
+	children map[string]*trieNode
+	rule     *routeRule
+}
+
+// insert 插入小写 FQDN 后缀。后缀已存在时不覆盖，返回已有的规则；插入成功时返回 rule
+func (t *domainTrie) insert(suffix string, rule *routeRule) *routeRule {
+	node := &t.root
+	labels := dns.SplitDomainName(suffix)
+	for i := len(labels) - 1; i >= 0; i-- {
+		child, ok := node.children[labels[i]]
+		if !ok {
+			if node.children == nil {
+				node.children = make(map[string]*trieNode)
+			}
+			child = &trieNode{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	if node.rule != nil {
+		return node.rule
+	}
+	node.rule = rule
+	return rule
+}
+
+// match 沿标签向下查找，返回最深（最长后缀）的匹配规则
+func (t *domainTrie) match(name string) *routeRule {
+	var matched *routeRule
+	node := &t.root
+	end := len(name) - 1 // 跳过末尾的点
+	for end > 0 {
+		start := strings.LastIndexByte(name[:end], '.') + 1
+		child, ok := node.children[name[start:end]]
+		if !ok {
+			break
+		}
+		node = child
+		if node.rule != nil {
+			matched = node.rule
+		}
+		end = start - 1
+	}
+	return matched
+}
+
+// loadDomainList 读取域名列表文件。支持每行一个域名的纯文本列表和
+// dnsmasq 格式（server=/example.com/114.114.114.114），dnsmasq 行中的服务器地址被忽略，
+// 查询始终发送到规则指定的上游组。空行与 # 开头的注释被跳过
+func loadDomainList(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open domain list: %v", err)
+	}
+	defer file.Close()
+
+	var domains []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		if value, ok := strings.CutPrefix(line, "server="); ok {
+			// server=/domain1/domain2/ip，至少需要一个域名
+			parts := strings.Split(value, "/")
+			if len(parts) < 3 || parts[0] != "" {
+				continue
+			}
+			for _, domain := range parts[1 : len(parts)-1] {
+				if domain != "" {
+					domains = append(domains, domain)
+				}
+			}
+			continue
+		}
+
+		domains = append(domains, strings.Fields(line)[0])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read domain list %s: %v", path, err)
+	}
+	return domains, nil
+}
+
+// normalizeDomain 将配置中的域名（允许 *.example.com 或 .example.com 形式）转换为小写 FQDN
+func normalizeDomain(domain string) string {
+	domain = strings.TrimPrefix(strings.TrimSpace(domain), "*")
+	domain = strings.TrimPrefix(domain, ".")
+	return strings.ToLower(dns.Fqdn(domain))
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"log"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 上游选择策略
+const (
+	strategyFailover   = "failover"
+	strategyParallel   = "parallel"
+	strategyFastest    = "fastest"
+	strategyRoundRobin = "round_robin"
+	strategyWeighted   = "weighted"
+)
+
+const (
+	// rttSmoothing 为 RTT 指数移动平均的新样本权重
+	rttSmoothing = 0.3
+	// fastestExploreRate 为 fastest 策略随机探测其他服务器的概率
+	fastestExploreRate   = 0.1
+	defaultParallelCount = 2
+)
+
+// upstream 表示一个上游服务器及其运行状态
+type upstream struct {
+	config  DoHServerConfig
+	breaker breakerSettings
+	mu      sync.Mutex
+	rtt     time.Duration
+	probed  bool
+	// 熔断状态，见 health_check.go
+	state    circuitState
+	failures int
+	openedAt time.Time
+	trialAt  time.Time
+}
+
+// updateRTT 更新 RTT 移动平均值，调用方需持有锁
+func (u *upstream) updateRTT(d time.Duration) {
+	if !u.probed {
+		u.rtt = d
+		u.probed = true
+		return
+	}
+	u.rtt = time.Duration(rttSmoothing*float64(d) + (1-rttSmoothing)*float64(u.rtt))
+}
+
+// averageRTT 返回 RTT 的移动平均值，尚无样本时返回 0 以便优先探测
+func (u *upstream) averageRTT() time.Duration {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.rtt
+}
+
+// weight 返回服务器权重，未配置时为 1
+func (u *upstream) weight() int {
+	if u.config.Weight <= 0 {
+		return 1
+	}
+	return u.config.Weight
+}
+
+// upstreamGroup 命名上游组，路由规则通过名称引用
+type upstreamGroup struct {
+	name     string
+	selector *upstreamSelector
+	// 发往该组服务器的查询使用的 ECS 策略
+	ecs *ecsPolicy
+}
+
+// upstreamSelector 按配置的策略决定上游服务器的尝试顺序
+type upstreamSelector struct {
+	strategy string
+	// parallel 策略同时查询的服务器数量
+	parallel  int
+	upstreams []*upstream
+	next      atomic.Uint64
+}
+
+// newUpstreamSelector 创建上游选择器
+func newUpstreamSelector(strategy string, parallel int, servers []DoHServerConfig, breaker breakerSettings) *upstreamSelector {
+	switch strategy {
+	case strategyFailover, strategyParallel, strategyFastest, strategyRoundRobin, strategyWeighted:
+	case "":
+		strategy = strategyFailover
+	default:
+		log.Printf("[WARNING] Unknown upstream strategy %q, using %s", strategy, strategyFailover)
+		strategy = strategyFailover
+	}
+
+	upstreams := make([]*upstream, 0, len(servers))
+	for _, server := range servers {
+		upstreams = append(upstreams, &upstream{config: server, breaker: breaker})
+	}
+
+	if parallel <= 0 {
+		parallel = defaultParallelCount
+	}
+
+	return &upstreamSelector{
+		strategy:  strategy,
+		parallel:  parallel,
+		upstreams: upstreams,
+	}
+}
+
+// order 返回本次查询的上游尝试顺序。熔断中的服务器被跳过，
+// 若所有服务器均处于熔断状态则仍按策略尝试全部服务器
+func (s *upstreamSelector) order() []*upstream {
+	ordered := make([]*upstream, 0, len(s.upstreams))
+	for _, u := range s.upstreams {
+		if u.available() {
+			ordered = append(ordered, u)
+		}
+	}
+	if len(ordered) == 0 {
+		ordered = append(ordered, s.upstreams...)
+	}
+	if len(ordered) < 2 {
+		return ordered
+	}
+
+	switch s.strategy {
+	case strategyRoundRobin:
+		start := int((s.next.Add(1) - 1) % uint64(len(ordered)))
+		ordered = append(ordered[start:], ordered[:start]...)
+
+	case strategyWeighted:
+		weightedShuffle(ordered)
+
+	case strategyFastest:
+		sort.SliceStable(ordered, func(i, j int) bool {
+			return ordered[i].averageRTT() < ordered[j].averageRTT()
+		})
+		// 偶尔将随机服务器提前，以便更新其他服务器的 RTT
+		if rand.Float64() < fastestExploreRate {
+			i := 1 + rand.IntN(len(ordered)-1)
+			ordered[0], ordered[i] = ordered[i], ordered[0]
+		}
+	}
+
+	return ordered
+}
+
+// weightedShuffle 按权重进行不放回随机排序
+func weightedShuffle(upstreams []*upstream) {
+	total := 0
+	for _, u := range upstreams {
+		total += u.weight()
+	}
+
+	for i := 0; i < len(upstreams)-1; i++ {
+		r := rand.IntN(total)
+		for j := i; j < len(upstreams); j++ {
+			r -= upstreams[j].weight()
+			if r < 0 {
+				upstreams[i], upstreams[j] = upstreams[j], upstreams[i]
+				break
+			}
+		}
+		total -= upstreams[i].weight()
+	}
+}